@@ -12,14 +12,22 @@ const (
 	HTTPS_SCHEMA_PREFIX = "https://"
 )
 
+// IsTLSAddress tells whether the server address
+// requires TLS to be spoken.
+func IsTLSAddress(address string) bool {
+	return strings.HasPrefix(strings.ToLower(address), HTTPS_SCHEMA_PREFIX)
+}
+
 func NormalizeAddress(address string) (res string, err error) {
 	var (
 		port string
 		host string
 	)
 
-	if !strings.HasPrefix(address, HTTP_SCHEMA_PREFIX) &&
-		!strings.HasPrefix(address, HTTPS_SCHEMA_PREFIX) {
+	// schemes are case-insensitive, as in IsTLSAddress.
+	scheme := strings.ToLower(address)
+	if !strings.HasPrefix(scheme, HTTP_SCHEMA_PREFIX) &&
+		!strings.HasPrefix(scheme, HTTPS_SCHEMA_PREFIX) {
 		address = HTTP_SCHEMA_PREFIX + address
 	}
 
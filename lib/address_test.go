@@ -23,6 +23,16 @@ func TestVerification(t *testing.T) {
 			"something.com:443",
 			false,
 		},
+		{
+			"HTTPS://something.com",
+			"something.com:443",
+			false,
+		},
+		{
+			"Http://127.0.0.1:8080",
+			"127.0.0.1:8080",
+			false,
+		},
 		{
 			"127.0.0.1",
 			"127.0.0.1:80",
@@ -60,3 +70,10 @@ func TestVerification(t *testing.T) {
 		})
 	}
 }
+
+func TestIsTLSAddress(t *testing.T) {
+	assert.True(t, IsTLSAddress("https://something.com"))
+	assert.True(t, IsTLSAddress("HTTPS://something.com"))
+	assert.False(t, IsTLSAddress("http://something.com"))
+	assert.False(t, IsTLSAddress("something.com"))
+}
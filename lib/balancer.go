@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ALGORITHM_ROUND_ROBIN          = "round-robin"
+	ALGORITHM_WEIGHTED_ROUND_ROBIN = "weighted-round-robin"
+	ALGORITHM_LEAST_CONNECTIONS    = "least-connections"
+	ALGORITHM_RANDOM_TWO_CHOICES   = "random-two-choices"
+	ALGORITHM_PEAK_EWMA            = "peak-ewma"
+
+	DEFAULT_ALGORITHM = ALGORITHM_LEAST_CONNECTIONS
+
+	// peakEWMADecay is the period over which past latency
+	// measurements lose most of their relevance.
+	peakEWMADecay = 10 * time.Second
+)
+
+// balancer picks the upstream that should receive a request.
+//
+// `candidates` holds the upstreams currently available (healthy
+// and not ejected) and is never empty. `key` identifies the
+// request for the balancers that need affinity.
+type balancer interface {
+	pick(candidates []*upstream, key []byte) *upstream
+}
+
+// balancerObserver is implemented by the balancers that take
+// the outcome of the requests into account.
+type balancerObserver interface {
+	observe(u *upstream, latency time.Duration, failed bool)
+}
+
+// balancerFactory creates a balancer for a given set of
+// upstreams with their respective weights.
+type balancerFactory func(upstreams []*upstream, weights []int) balancer
+
+// balancers holds the available load-balancing algorithms.
+//
+// To add a new algorithm, implement `balancer` and register
+// its factory here.
+var balancers = map[string]balancerFactory{
+	ALGORITHM_ROUND_ROBIN:          newRoundRobin,
+	ALGORITHM_WEIGHTED_ROUND_ROBIN: newWeightedRoundRobin,
+	ALGORITHM_LEAST_CONNECTIONS:    newLeastConnections,
+	ALGORITHM_RANDOM_TWO_CHOICES:   newRandomTwoChoices,
+	ALGORITHM_PEAK_EWMA:            newPeakEWMA,
+	ALGORITHM_CONSISTENT_HASH:      newConsistentHash,
+}
+
+// Algorithms lists the names of the load-balancing
+// algorithms supported.
+func Algorithms() (names []string) {
+	for name := range balancers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return
+}
+
+func newBalancer(algorithm string, upstreams []*upstream, weights []int) (b balancer, err error) {
+	if algorithm == "" {
+		algorithm = DEFAULT_ALGORITHM
+	}
+
+	factory, found := balancers[algorithm]
+	if !found {
+		err = errors.Errorf(
+			"unknown load-balancing algorithm %s (available: %v)",
+			algorithm, Algorithms())
+		return
+	}
+
+	b = factory(upstreams, weights)
+	return
+}
+
+// roundRobin hands requests to each upstream in turn.
+type roundRobin struct {
+	next uint32
+}
+
+func newRoundRobin(upstreams []*upstream, weights []int) balancer {
+	return &roundRobin{}
+}
+
+func (b *roundRobin) pick(candidates []*upstream, key []byte) *upstream {
+	var ndx = atomic.AddUint32(&b.next, 1) % uint32(len(candidates))
+	return candidates[ndx]
+}
+
+// weightedRoundRobin implements nginx's smooth weighted
+// round-robin: upstreams get requests proportionally to their
+// weights without being picked in bursts.
+type weightedRoundRobin struct {
+	sync.Mutex
+	weights map[*upstream]int
+	current map[*upstream]int
+}
+
+func newWeightedRoundRobin(upstreams []*upstream, weights []int) balancer {
+	var b = &weightedRoundRobin{
+		weights: make(map[*upstream]int, len(upstreams)),
+		current: make(map[*upstream]int, len(upstreams)),
+	}
+
+	for ndx, u := range upstreams {
+		b.weights[u] += weights[ndx]
+	}
+
+	return b
+}
+
+func (b *weightedRoundRobin) pick(candidates []*upstream, key []byte) (u *upstream) {
+	var total int
+
+	b.Lock()
+	defer b.Unlock()
+
+	for _, candidate := range candidates {
+		b.current[candidate] += b.weights[candidate]
+		total += b.weights[candidate]
+
+		if u == nil || b.current[candidate] > b.current[u] {
+			u = candidate
+		}
+	}
+
+	b.current[u] -= total
+	return
+}
+
+// leastConnections picks the upstream with the least number
+// of pending requests, spreading the requests among the
+// equally loaded ones in a round-robin fashion.
+type leastConnections struct {
+	next uint32
+}
+
+func newLeastConnections(upstreams []*upstream, weights []int) balancer {
+	return &leastConnections{}
+}
+
+func (b *leastConnections) pick(candidates []*upstream, key []byte) (u *upstream) {
+	var (
+		n     = uint32(len(candidates))
+		start = atomic.AddUint32(&b.next, 1)
+	)
+
+	for i := uint32(0); i < n; i++ {
+		candidate := candidates[(start+i)%n]
+		if u == nil ||
+			candidate.pending() < u.pending() {
+			u = candidate
+		}
+	}
+
+	return
+}
+
+// pickTwo randomly picks two distinct candidates (or the same
+// one twice if there's a single candidate).
+func pickTwo(candidates []*upstream) (a, b *upstream) {
+	var n = len(candidates)
+	if n == 1 {
+		return candidates[0], candidates[0]
+	}
+
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+
+	return candidates[i], candidates[j]
+}
+
+// randomTwoChoices picks two random upstreams and sends the
+// request to the least loaded of them.
+type randomTwoChoices struct{}
+
+func newRandomTwoChoices(upstreams []*upstream, weights []int) balancer {
+	return &randomTwoChoices{}
+}
+
+func (b *randomTwoChoices) pick(candidates []*upstream, key []byte) *upstream {
+	first, second := pickTwo(candidates)
+	if second.pending() < first.pending() {
+		return second
+	}
+
+	return first
+}
+
+type ewma struct {
+	sync.Mutex
+	value     float64
+	timestamp time.Time
+}
+
+// peakEWMA keeps an exponentially weighted moving average of the
+// latency of each upstream that reacts immediately to latency
+// peaks, picking (out of two random choices) the upstream with the
+// lowest latency weighted by its number of pending requests.
+type peakEWMA struct {
+	latencies map[*upstream]*ewma
+}
+
+func newPeakEWMA(upstreams []*upstream, weights []int) balancer {
+	var b = &peakEWMA{
+		latencies: make(map[*upstream]*ewma, len(upstreams)),
+	}
+
+	for _, u := range upstreams {
+		b.latencies[u] = &ewma{}
+	}
+
+	return b
+}
+
+func (b *peakEWMA) cost(u *upstream) float64 {
+	var e = b.latencies[u]
+
+	e.Lock()
+	defer e.Unlock()
+
+	return (e.value + 1) * float64(u.pending()+1)
+}
+
+func (b *peakEWMA) pick(candidates []*upstream, key []byte) *upstream {
+	first, second := pickTwo(candidates)
+	if b.cost(second) < b.cost(first) {
+		return second
+	}
+
+	return first
+}
+
+func (b *peakEWMA) observe(u *upstream, latency time.Duration, failed bool) {
+	var (
+		e   = b.latencies[u]
+		now = time.Now()
+		rtt = float64(latency)
+	)
+
+	e.Lock()
+	defer e.Unlock()
+
+	if rtt > e.value {
+		e.value = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(e.timestamp)) / float64(peakEWMADecay))
+		e.value = e.value*w + rtt*(1-w)
+	}
+
+	e.timestamp = now
+}
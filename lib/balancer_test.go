@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func upstreamsFor(addresses ...string) (upstreams []*upstream) {
+	for _, address := range addresses {
+		upstreams = append(upstreams, newUpstream(address, nil))
+	}
+
+	return
+}
+
+func countPicks(b balancer, candidates []*upstream, n int) map[string]int {
+	var picks = make(map[string]int)
+
+	for i := 0; i < n; i++ {
+		picks[b.pick(candidates, nil).address]++
+	}
+
+	return picks
+}
+
+func TestNewBalancer(t *testing.T) {
+	var upstreams = upstreamsFor("a:80")
+
+	for _, algorithm := range append(Algorithms(), "") {
+		t.Run(algorithm, func(t *testing.T) {
+			b, err := newBalancer(algorithm, upstreams, []int{1})
+			assert.NoError(t, err)
+			assert.Equal(t, upstreams[0], b.pick(upstreams, nil))
+		})
+	}
+
+	_, err := newBalancer("something", upstreams, []int{1})
+	assert.Error(t, err)
+}
+
+func TestRoundRobin_pick(t *testing.T) {
+	var upstreams = upstreamsFor("a:80", "b:80", "c:80")
+
+	assert.Equal(t,
+		map[string]int{"a:80": 10, "b:80": 10, "c:80": 10},
+		countPicks(newRoundRobin(upstreams, nil), upstreams, 30))
+}
+
+func TestWeightedRoundRobin_pick(t *testing.T) {
+	var (
+		upstreams = upstreamsFor("a:80", "b:80", "c:80")
+		b         = newWeightedRoundRobin(upstreams, []int{5, 1, 1})
+		sequence  []string
+	)
+
+	for i := 0; i < 7; i++ {
+		sequence = append(sequence, b.pick(upstreams, nil).address)
+	}
+
+	// smooth: the heaviest upstream doesn't get
+	// all of its requests in a burst.
+	assert.Equal(t, []string{
+		"a:80", "a:80", "b:80", "a:80", "c:80", "a:80", "a:80",
+	}, sequence)
+
+	// unavailable upstreams are skipped.
+	assert.Equal(t,
+		map[string]int{"b:80": 5, "c:80": 5},
+		countPicks(b, upstreams[1:], 10))
+}
+
+func TestRandomTwoChoices_pick(t *testing.T) {
+	var upstreams = upstreamsFor("a:80", "b:80")
+
+	picks := countPicks(newRandomTwoChoices(upstreams, nil), upstreams, 10)
+	assert.Equal(t, 10, picks["a:80"]+picks["b:80"])
+}
+
+func TestPeakEWMA_prefersLowerLatencies(t *testing.T) {
+	var (
+		upstreams = upstreamsFor("a:80", "b:80")
+		b         = newPeakEWMA(upstreams, nil).(*peakEWMA)
+	)
+
+	b.observe(upstreams[0], 100*time.Millisecond, false)
+	b.observe(upstreams[1], time.Millisecond, false)
+
+	assert.Equal(t,
+		map[string]int{"b:80": 10},
+		countPicks(b, upstreams, 10))
+
+	// a peak is taken into account immediately
+	b.observe(upstreams[1], time.Second, false)
+	assert.Equal(t,
+		map[string]int{"a:80": 10},
+		countPicks(b, upstreams, 10))
+}
@@ -0,0 +1,238 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	CLIENT_AUTH_REQUIRE  = "require"
+	CLIENT_AUTH_OPTIONAL = "optional"
+
+	DEFAULT_CLIENT_AUTH = CLIENT_AUTH_REQUIRE
+
+	// clientSubjectKey holds the subject of the verified
+	// client certificate within the request context.
+	clientSubjectKey = "client"
+)
+
+var (
+	clientSubjectHeader = []byte("X-Client-Cert-Subject")
+)
+
+// ClientAuth configures the authentication of clients by
+// their TLS certificates (mutual TLS).
+//
+// Certificates must be signed by one of the authorities in the
+// `CA` bundle. With `Verify` set to `optional`, clients that
+// don't present a certificate are let through (unidentified).
+//
+// `AllowedSubjects` and `AllowedSANs` restrict the certificates
+// accepted to those whose subject (e.g., `CN=api,O=Example`) or
+// one of whose subject alternative names (DNS names, emails,
+// URIs or IPs) match one of the patterns (e.g., `*.internal`).
+type ClientAuth struct {
+	CA              string   `yaml:"ca"`
+	Verify          string   `yaml:"verify"`
+	AllowedSubjects []string `yaml:"allowed_subjects"`
+	AllowedSANs     []string `yaml:"allowed_sans"`
+
+	pool *x509.CertPool
+}
+
+// prepare fills the fields not specified with their
+// defaults, loads the CA bundle and validates the
+// configuration.
+func (ca *ClientAuth) prepare() (err error) {
+	if ca.Verify == "" {
+		ca.Verify = DEFAULT_CLIENT_AUTH
+	}
+
+	if ca.Verify != CLIENT_AUTH_REQUIRE && ca.Verify != CLIENT_AUTH_OPTIONAL {
+		err = errors.Errorf(
+			"client auth verify must be one of '%s' or '%s' (got %s)",
+			CLIENT_AUTH_REQUIRE, CLIENT_AUTH_OPTIONAL, ca.Verify)
+		return
+	}
+
+	if ca.CA == "" {
+		err = errors.Errorf(
+			"client auth requires a ca bundle")
+		return
+	}
+
+	pem, err := ioutil.ReadFile(ca.CA)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't read client ca bundle %s", ca.CA)
+		return
+	}
+
+	ca.pool = x509.NewCertPool()
+	if !ca.pool.AppendCertsFromPEM(pem) {
+		err = errors.Errorf(
+			"no certificates found in client ca bundle %s", ca.CA)
+		return
+	}
+
+	for _, pattern := range append(ca.AllowedSubjects, ca.AllowedSANs...) {
+		_, err = path.Match(pattern, "")
+		if err != nil {
+			err = errors.Wrapf(err,
+				"invalid client auth pattern %s", pattern)
+			return
+		}
+	}
+
+	return
+}
+
+// mode is the client authentication performed during
+// the handshakes.
+func (ca *ClientAuth) mode() tls.ClientAuthType {
+	if ca.Verify == CLIENT_AUTH_OPTIONAL {
+		return tls.VerifyClientCertIfGiven
+	}
+
+	return tls.RequireAndVerifyClientCert
+}
+
+func matchesAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// allows tells whether the certificate matches the
+// subject and SAN restrictions (if any).
+func (ca *ClientAuth) allows(cert *x509.Certificate) bool {
+	if len(ca.AllowedSubjects) == 0 && len(ca.AllowedSANs) == 0 {
+		return true
+	}
+
+	var sans = append(cert.DNSNames[:len(cert.DNSNames):len(cert.DNSNames)],
+		cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+
+	return matchesAny(ca.AllowedSubjects, cert.Subject.String()) ||
+		matchesAny(ca.AllowedSANs, sans...)
+}
+
+// verify retrieves the subject of the client certificate
+// presented in the connection, making sure it's acceptable.
+//
+// Certificates are verified again (rather than relying on the
+// handshake) as the backend requested might not be the one
+// whose settings were used when handshaking.
+func (ca *ClientAuth) verify(state *tls.ConnectionState) (subject string, err error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		if ca.Verify == CLIENT_AUTH_REQUIRE {
+			err = errors.Errorf("client certificate required")
+		}
+		return
+	}
+
+	var (
+		leaf          = state.PeerCertificates[0]
+		intermediates = x509.NewCertPool()
+	)
+
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         ca.pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid client certificate")
+		return
+	}
+
+	if !ca.allows(leaf) {
+		err = errors.Errorf(
+			"client certificate %s not allowed", leaf.Subject)
+		return
+	}
+
+	subject = leaf.Subject.String()
+	return
+}
+
+// clientAuthFor retrieves the client authentication settings
+// that apply to a backend: its own or the listener's.
+func (lb *L7) clientAuthFor(rt *routeTable) (ca *ClientAuth) {
+	if rt != nil && rt.clientAuth != nil {
+		return rt.clientAuth
+	}
+
+	lb.RLock()
+	ca = lb.clientAuth
+	lb.RUnlock()
+	return
+}
+
+// authenticateClient verifies the client certificate of the
+// request against the settings of the backend, making the
+// client identity (if any) available to the upstream servers
+// through the `X-Client-Cert-Subject` header.
+func (lb *L7) authenticateClient(ctx *fasthttp.RequestCtx, rt *routeTable) (identified, ok bool) {
+	// the header can't be trusted if coming from the client,
+	// whatever the case it's sent with.
+	delHeaders(&ctx.Request.Header, func(name string) bool {
+		return name == string(clientSubjectHeader)
+	})
+
+	var ca = lb.clientAuthFor(rt)
+	if ca == nil {
+		ok = true
+		return
+	}
+
+	subject, err := ca.verify(ctx.TLSConnectionState())
+	if err != nil {
+		lb.logger.Info().
+			Uint64("id", ctx.ConnID()).
+			Str("request_id", requestIDOf(ctx)).
+			Str("client", ctx.RemoteIP().String()).
+			Err(err).
+			Msg("client authentication failed")
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		return
+	}
+
+	ok = true
+	if subject == "" {
+		return
+	}
+
+	lb.logger.Debug().
+		Uint64("id", ctx.ConnID()).
+		Str("request_id", requestIDOf(ctx)).
+		Str("subject", subject).
+		Msg("client authenticated")
+
+	identified = true
+	ctx.SetUserValue(clientSubjectKey, subject)
+	ctx.Request.Header.SetBytesK(clientSubjectHeader, subject)
+	return
+}
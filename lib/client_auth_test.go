@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientAuth_prepare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l7-client-auth")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, _ := createCertificate(t, dir, "client")
+
+	var testCases = []struct {
+		config      ClientAuth
+		shouldError bool
+	}{
+		{ClientAuth{CA: ca}, false},
+		{ClientAuth{CA: ca, Verify: "optional", AllowedSANs: []string{"*.internal"}}, false},
+		{ClientAuth{}, true},
+		{ClientAuth{CA: filepath.Join(dir, "missing.pem")}, true},
+		{ClientAuth{CA: ca, Verify: "sometimes"}, true},
+		{ClientAuth{CA: ca, AllowedSubjects: []string{"CN=[a"}}, true},
+	}
+
+	for _, tc := range testCases {
+		err := tc.config.prepare()
+		if tc.shouldError {
+			assert.Error(t, err)
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.NotEqual(t, "", tc.config.Verify)
+	}
+}
+
+func TestClientAuth_allows(t *testing.T) {
+	var cert = &x509.Certificate{
+		DNSNames:       []string{"api.internal"},
+		EmailAddresses: []string{"ops@example.com"},
+	}
+	cert.Subject.CommonName = "api"
+	cert.Subject.Organization = []string{"Example"}
+
+	var testCases = []struct {
+		subjects []string
+		sans     []string
+		expected bool
+	}{
+		{nil, nil, true},
+		{[]string{"CN=api,O=Example"}, nil, true},
+		{[]string{"CN=api,*"}, nil, true},
+		{[]string{"CN=web,*"}, nil, false},
+		{nil, []string{"*.internal"}, true},
+		{nil, []string{"*@example.com"}, true},
+		{nil, []string{"*.external"}, false},
+		{[]string{"CN=web,*"}, []string{"api.*"}, true},
+	}
+
+	for _, tc := range testCases {
+		ca := &ClientAuth{AllowedSubjects: tc.subjects, AllowedSANs: tc.sans}
+		assert.Equal(t, tc.expected, ca.allows(cert), "%v %v", tc.subjects, tc.sans)
+	}
+}
+
+func TestL7_authenticatesClientsByCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l7-client-auth")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s", r.Header.Get("X-Client-Cert-Subject"))
+	}))
+	defer server.Close()
+
+	serverCert, serverKey := createCertificate(t, dir, "default")
+	clientCert, clientKey := createCertificate(t, dir, "client")
+	intruderCert, intruderKey := createCertificate(t, dir, "intruder")
+
+	lb, err := New(Config{
+		TLS: &TLS{
+			Cert:       serverCert,
+			Key:        serverKey,
+			ClientAuth: &ClientAuth{CA: clientCert},
+		},
+		Users: map[string]string{"user": "pass"},
+		Backends: map[string]Backend{
+			"listener.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+			"strict.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+				ClientAuth: &ClientAuth{
+					CA:              clientCert,
+					AllowedSubjects: []string{"CN=admin"},
+				},
+			},
+			"optional.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+				ClientAuth: &ClientAuth{
+					CA:     clientCert,
+					Verify: "optional",
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	lb.tlsPort = 0
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	assert.NoError(t, err)
+	intruder, err := tls.LoadX509KeyPair(intruderCert, intruderKey)
+	assert.NoError(t, err)
+
+	var testCases = []struct {
+		host        string
+		cert        *tls.Certificate
+		status      int
+		body        string
+		shouldError bool
+	}{
+		{"listener.com", &client, 200, "CN=client", false},
+		{"listener.com", nil, 0, "", true},
+		{"listener.com", &intruder, 0, "", true},
+		{"strict.com", &client, 403, "", false},
+		{"optional.com", &client, 200, "CN=client", false},
+		{"optional.com", nil, 200, "", false},
+		{"optional.com", &intruder, 0, "", true},
+	}
+
+	for _, tc := range testCases {
+		var config = &tls.Config{
+			ServerName:         tc.host,
+			InsecureSkipVerify: true,
+		}
+		if tc.cert != nil {
+			config.Certificates = []tls.Certificate{*tc.cert}
+		}
+
+		httpClient := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: config},
+		}
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("https://localhost:%d/", lb.tlsPort), nil)
+		assert.NoError(t, err)
+		req.Host = tc.host
+		req.Header.Set("X-Client-Cert-Subject", "CN=spoofed")
+		if tc.cert == nil {
+			req.SetBasicAuth("user", "pass")
+		}
+
+		resp, err := httpClient.Do(req)
+		if tc.shouldError {
+			if err == nil {
+				// TLS 1.3 clients only learn about the
+				// rejection when reading the response.
+				resp.Body.Close()
+			}
+			assert.True(t, err != nil || resp.StatusCode != 200, tc.host)
+			continue
+		}
+
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err)
+
+		assert.Equal(t, tc.status, resp.StatusCode, tc.host)
+		if tc.status == 200 {
+			assert.Equal(t, tc.body, string(data), tc.host)
+		}
+	}
+}
+
+func TestL7_removesSubjectSentByTheClients(t *testing.T) {
+	var server = createHeadersServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	for _, name := range []string{"X-Client-Cert-Subject", "x-client-cert-subject", "X-CLIENT-CERT-SUBJECT"} {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d", lb.port), nil)
+		assert.NoError(t, err)
+
+		// set directly so that the case is kept.
+		req.Header[name] = []string{"CN=admin"}
+		req.Host = "example.com"
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("X-Echo-X-Client-Cert-Subject"), name)
+	}
+}
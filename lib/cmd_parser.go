@@ -31,6 +31,41 @@ func EqualSeparatedToMap(strs []string) (res map[string][]string, err error) {
 	return
 }
 
+// splitRouteSpecification splits a backend specification as
+// passed via the command line into the domain and the route
+// rule that it carries (if any).
+//
+//	example.com            -> example.com, catch-all
+//	example.com/api        -> example.com, prefix /api
+//	example.com~^/v[0-9]/  -> example.com, regex ^/v[0-9]/
+//	~^api\.[a-z]+\.com$/v1 -> ~^api\.[a-z]+\.com$, prefix /v1
+func splitRouteSpecification(spec string) (domain string, route Route) {
+	var start = 0
+
+	// the tilde that marks a regex domain
+	// is not a route separator.
+	if strings.HasPrefix(spec, REGEX_PREFIX) {
+		start = len(REGEX_PREFIX)
+	}
+
+	var ndx = strings.IndexAny(spec[start:], "/~")
+	if ndx == -1 {
+		domain = spec
+		return
+	}
+
+	ndx += start
+
+	domain = spec[:ndx]
+	if spec[ndx] == '~' {
+		route.Regex = spec[ndx+1:]
+	} else {
+		route.Prefix = spec[ndx:]
+	}
+
+	return
+}
+
 func EqualSeparatedToBackends(list []string) (backends map[string]Backend, err error) {
 	if len(list) == 0 {
 		err = errors.Errorf(
@@ -38,23 +73,57 @@ func EqualSeparatedToBackends(list []string) (backends map[string]Backend, err e
 		return
 	}
 
-	serverMap, err := EqualSeparatedToMap(list)
-	if err != nil {
-		err = errors.Wrapf(err,
-			"Couldn't retrieve map from server list %v", list)
-		return
-	}
+	var (
+		pair    []string
+		domain  string
+		route   Route
+		backend Backend
+		ndx     int
+		found   bool
+	)
 
+	// iterate over the list (instead of the map) so that
+	// the order of the routes is preserved.
 	backends = make(map[string]Backend)
-	for domain, servers := range serverMap {
-		backend := Backend{
-			Servers: []Server{},
+	for _, str := range list {
+		pair = strings.SplitN(str, "=", 2)
+		if len(pair) != 2 {
+			err = errors.Errorf(
+				"Server specification (%s) should be "+
+					"in the form domain=address", str)
+			return
+		}
+
+		domain, route = splitRouteSpecification(pair[0])
+		server := Server{
+			Address: pair[1],
+		}
+
+		backend, found = backends[domain]
+		if !found {
+			backend = Backend{
+				Servers: []Server{},
+			}
+		}
+
+		if route.Name() == "*" {
+			backend.Servers = append(backend.Servers, server)
+			backends[domain] = backend
+			continue
 		}
-		for _, address := range servers {
-			backend.Servers = append(backend.Servers, Server{
-				Address: address,
-			})
+
+		for ndx = 0; ndx < len(backend.Routes); ndx++ {
+			if backend.Routes[ndx].Name() == route.Name() {
+				break
+			}
 		}
+
+		if ndx == len(backend.Routes) {
+			backend.Routes = append(backend.Routes, route)
+		}
+
+		backend.Routes[ndx].Servers = append(
+			backend.Routes[ndx].Servers, server)
 		backends[domain] = backend
 	}
 
@@ -60,3 +60,91 @@ func TestEqualSeparatedToMap(t *testing.T) {
 		})
 	}
 }
+
+func TestEqualSeparatedToBackends(t *testing.T) {
+	var testCases = []struct {
+		description string
+		input       []string
+		output      map[string]Backend
+	}{
+		{
+			"groups servers by domain",
+			[]string{"a.com=s1", "a.com=s2", "b.com=s3"},
+			map[string]Backend{
+				"a.com": Backend{Servers: []Server{{Address: "s1"}, {Address: "s2"}}},
+				"b.com": Backend{Servers: []Server{{Address: "s3"}}},
+			},
+		},
+		{
+			"creates prefix routes",
+			[]string{"a.com=s1", "a.com/api=s2", "a.com/api=s3"},
+			map[string]Backend{
+				"a.com": Backend{
+					Servers: []Server{{Address: "s1"}},
+					Routes: []Route{
+						{Prefix: "/api", Servers: []Server{{Address: "s2"}, {Address: "s3"}}},
+					},
+				},
+			},
+		},
+		{
+			"creates regex routes preserving order",
+			[]string{"a.com~^/v2/=s1", "a.com/static=s2", "a.com~^/v=s3"},
+			map[string]Backend{
+				"a.com": Backend{
+					Servers: []Server{},
+					Routes: []Route{
+						{Regex: "^/v2/", Servers: []Server{{Address: "s1"}}},
+						{Prefix: "/static", Servers: []Server{{Address: "s2"}}},
+						{Regex: "^/v", Servers: []Server{{Address: "s3"}}},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			actual, err := EqualSeparatedToBackends(tc.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.output, actual)
+		})
+	}
+}
+
+func TestEqualSeparatedToBackends_failsOnInvalidSpecifications(t *testing.T) {
+	var testCases = [][]string{
+		{},
+		{"a.com"},
+		{"a.com=s1", "b.com"},
+	}
+
+	for _, tc := range testCases {
+		_, err := EqualSeparatedToBackends(tc)
+		assert.Error(t, err, "%v", tc)
+	}
+}
+
+func TestSplitRouteSpecification(t *testing.T) {
+	var testCases = []struct {
+		input  string
+		domain string
+		route  Route
+	}{
+		{"example.com", "example.com", Route{}},
+		{"example.com/api", "example.com", Route{Prefix: "/api"}},
+		{"example.com~^/v[0-9]/", "example.com", Route{Regex: "^/v[0-9]/"}},
+		{"*.example.com/api", "*.example.com", Route{Prefix: "/api"}},
+		{"*", "*", Route{}},
+		{"~^api\\.", "~^api\\.", Route{}},
+		{"~^api\\./v1", "~^api\\.", Route{Prefix: "/v1"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			domain, route := splitRouteSpecification(tc.input)
+			assert.Equal(t, tc.domain, domain)
+			assert.Equal(t, tc.route, route)
+		})
+	}
+}
@@ -3,6 +3,7 @@ package lib
 import (
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
@@ -10,10 +11,53 @@ import (
 
 type Server struct {
 	Address string `yaml:"address"`
+	Weight  int    `yaml:"weight"`
 }
 
-type Backend struct {
+// Route directs the requests whose path matches one of
+// its rules to a dedicated set of servers.
+//
+// Exactly one of Path (exact match), Prefix or Regex must be
+// specified.
+type Route struct {
+	Path    string   `yaml:"path"`
+	Prefix  string   `yaml:"prefix"`
+	Regex   string   `yaml:"regex"`
 	Servers []Server `yaml:"servers"`
+
+	RequestHeaders  *HeaderRules `yaml:"request_headers"`
+	ResponseHeaders *HeaderRules `yaml:"response_headers"`
+	Rewrite         *Rewrite     `yaml:"rewrite"`
+
+	Redirect      *Redirect      `yaml:"redirect"`
+	FixedResponse *FixedResponse `yaml:"fixed_response"`
+}
+
+type Backend struct {
+	Algorithm        string            `yaml:"algorithm"`
+	HashOn           string            `yaml:"hash_on"`
+	Servers          []Server          `yaml:"servers"`
+	Routes           []Route           `yaml:"routes"`
+	Protocol         string            `yaml:"protocol"`
+	HealthCheck      *HealthCheck      `yaml:"health_check"`
+	OutlierDetection *OutlierDetection `yaml:"outlier_detection"`
+	Sticky           *Sticky           `yaml:"sticky"`
+	TLS              *BackendTLS       `yaml:"tls"`
+	UpstreamTLS      *UpstreamTLS      `yaml:"upstream_tls"`
+	ForceHTTPS       bool              `yaml:"force_https"`
+	TLSPassthrough   bool              `yaml:"tls_passthrough"`
+	HSTS             *HSTS             `yaml:"hsts"`
+	ClientAuth       *ClientAuth       `yaml:"client_auth"`
+
+	TunnelIdleTimeout time.Duration `yaml:"tunnel_idle_timeout"`
+	SendProxyProtocol string        `yaml:"send_proxy_protocol"`
+
+	RequestHeaders  *HeaderRules `yaml:"request_headers"`
+	ResponseHeaders *HeaderRules `yaml:"response_headers"`
+	Rewrite         *Rewrite     `yaml:"rewrite"`
+
+	Redirect      *Redirect      `yaml:"redirect"`
+	FixedResponse *FixedResponse `yaml:"fixed_response"`
 }
 
 type Config struct {
@@ -21,6 +65,17 @@ type Config struct {
 	Backends map[string]Backend `yaml:"backends"`
 	Users    map[string]string  `yaml:"users"`
 	Debug    bool               `yaml:"debug"`
+	TLS      *TLS               `yaml:"tls"`
+	HTTP2    *HTTP2             `yaml:"http2"`
+	TCP      map[string]TCP     `yaml:"tcp"`
+
+	ProxyProtocol    *ProxyProtocol    `yaml:"proxy_protocol"`
+	ForwardedHeaders *ForwardedHeaders `yaml:"forwarded_headers"`
+	RequestID        *RequestID        `yaml:"request_id"`
+
+	StripAuthorization bool `yaml:"strip_authorization"`
+
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
 }
 
 func NewConfigFromYamlFile(file string) (cfg Config, err error) {
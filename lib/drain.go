@@ -0,0 +1,270 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_DRAIN_TIMEOUT = 30 * time.Second
+
+	// drainPollInterval is how often the connections are
+	// checked while draining.
+	drainPollInterval = 50 * time.Millisecond
+)
+
+// connTracker keeps track of the connections accepted by the
+// listeners so that they can be drained when shutting down.
+type connTracker struct {
+	sync.Mutex
+	conns map[*trackedConn]struct{}
+
+	inFlight int64
+	draining int32
+	drained  chan struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns:   make(map[*trackedConn]struct{}),
+		drained: make(chan struct{}),
+	}
+}
+
+func (t *connTracker) isDraining() bool {
+	return atomic.LoadInt32(&t.draining) == 1
+}
+
+func (t *connTracker) count() int {
+	t.Lock()
+	defer t.Unlock()
+
+	return len(t.conns)
+}
+
+// closeIdle closes the connections that are waiting for a new
+// request (unless long-lived), returning how many connections
+// are left.
+func (t *connTracker) closeIdle() (left int) {
+	t.Lock()
+	var idle []*trackedConn
+	for c := range t.conns {
+		if atomic.LoadInt32(&c.idle) == 1 && atomic.LoadInt32(&c.longLived) == 0 {
+			idle = append(idle, c)
+		}
+	}
+	left = len(t.conns) - len(idle)
+	t.Unlock()
+
+	for _, c := range idle {
+		c.Close()
+	}
+
+	return
+}
+
+// closeAll closes all the connections, returning
+// how many were closed.
+func (t *connTracker) closeAll() (closed int) {
+	t.Lock()
+	var conns = make([]*trackedConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+
+	return len(conns)
+}
+
+// setTunneled marks the connection between the given addresses
+// as tunneled: it's never considered idle from then on.
+func (t *connTracker) setTunneled(local, remote net.Addr) {
+	t.Lock()
+	defer t.Unlock()
+
+	for c := range t.conns {
+		if c.LocalAddr().String() == local.String() &&
+			c.RemoteAddr().String() == remote.String() {
+			c.setLongLived()
+			return
+		}
+	}
+}
+
+// trackingListener registers the connections it accepts
+// within a tracker.
+type trackingListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (l *trackingListener) Accept() (conn net.Conn, err error) {
+	conn, err = l.Listener.Accept()
+	if err != nil {
+		return
+	}
+
+	c := &trackedConn{
+		Conn:    conn,
+		tracker: l.tracker,
+	}
+
+	l.tracker.Lock()
+	l.tracker.conns[c] = struct{}{}
+	l.tracker.Unlock()
+
+	conn = c
+	return
+}
+
+// trackedConn is idle from the moment it starts waiting for
+// a new request (after writing a response) until data arrives.
+// Connections just accepted aren't idle: their first request
+// may be on its way already.
+//
+// Long-lived connections (tunnels and HTTP/2 connections) are
+// never idle: they're closed by whoever serves them.
+type trackedConn struct {
+	net.Conn
+	tracker   *connTracker
+	idle      int32
+	wrote     int32
+	longLived int32
+	once      sync.Once
+}
+
+func (c *trackedConn) setLongLived() {
+	atomic.StoreInt32(&c.longLived, 1)
+}
+
+func (c *trackedConn) Read(b []byte) (n int, err error) {
+	if atomic.CompareAndSwapInt32(&c.wrote, 1, 0) {
+		atomic.StoreInt32(&c.idle, 1)
+	}
+
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt32(&c.idle, 0)
+	}
+
+	return
+}
+
+func (c *trackedConn) Write(b []byte) (n int, err error) {
+	atomic.StoreInt32(&c.wrote, 1)
+	return c.Conn.Write(b)
+}
+
+func (c *trackedConn) Close() (err error) {
+	c.once.Do(func() {
+		c.tracker.Lock()
+		delete(c.tracker.conns, c)
+		c.tracker.Unlock()
+
+		err = c.Conn.Close()
+	})
+
+	return
+}
+
+// Shutdown gracefully stops the load-balancer: it stops
+// accepting connections, closes the idle ones and lets the
+// requests in flight finish (their connections being closed
+// right after) for up to the drain timeout, closing the
+// connections left after that.
+//
+// An error is returned if connections had to be closed due
+// to the timeout.
+func (lb *L7) Shutdown() (err error) {
+	return lb.shutdown(lb.drainTimeout)
+}
+
+// Stop immediately stops the load-balancer, closing all the
+// connections regardless of the requests in flight.
+func (lb *L7) Stop() {
+	lb.shutdown(0)
+}
+
+func (lb *L7) shutdown(timeout time.Duration) (err error) {
+	var (
+		t        = lb.conns
+		deadline = time.Now().Add(timeout)
+	)
+
+	if !atomic.CompareAndSwapInt32(&t.draining, 0, 1) {
+		<-t.drained
+		return
+	}
+
+	lb.logger.Info().
+		Dur("timeout", timeout).
+		Int("connections", t.count()).
+		Msg("draining connections")
+
+	lb.RLock()
+	if lb.listener != nil {
+		lb.listener.Close()
+	}
+
+	if lb.tlsListener != nil {
+		lb.tlsListener.Close()
+	}
+
+	for _, l := range lb.tcpListeners {
+		l.Close()
+	}
+	lb.RUnlock()
+
+	// HTTP/2 clients are told to stop sending requests
+	// through the connections (GOAWAY), which are then
+	// closed once the streams in flight finish.
+	if lb.h2Server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		go lb.h2Server.Shutdown(ctx)
+	}
+
+	for t.closeIdle() > 0 {
+		if time.Now().After(deadline) {
+			inFlight := atomic.LoadInt64(&t.inFlight)
+			closed := t.closeAll()
+
+			lb.logger.Warn().
+				Int("connections", closed).
+				Int64("in_flight", inFlight).
+				Msg("drain timeout reached, closing connections")
+
+			err = errors.Errorf(
+				"drain timeout reached with %d connections open "+
+					"(%d requests in flight)", closed, inFlight)
+			break
+		}
+
+		time.Sleep(drainPollInterval)
+	}
+
+	lb.RLock()
+	for _, u := range lb.upstreams {
+		u.setHealthCheck(nil, lb.logger)
+	}
+	for _, u := range lb.tcpUpstreams {
+		u.setHealthCheck(nil, lb.logger)
+	}
+	lb.RUnlock()
+
+	lb.logger.Info().
+		Msg("connections drained")
+
+	close(t.drained)
+	return
+}
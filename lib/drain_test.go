@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createSlowServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		fmt.Fprintf(w, "slow")
+	}))
+}
+
+func TestL7_drainsConnectionsOnShutdown(t *testing.T) {
+	var server = createSlowServer(300 * time.Millisecond)
+	defer server.Close()
+
+	lb, err := New(Config{
+		DrainTimeout: 2 * time.Second,
+		Backends: map[string]Backend{
+			"*": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	listened := make(chan error, 1)
+	go func() {
+		listened <- lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// a keep-alive connection left idle after a request
+	idle, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", lb.port))
+	assert.NoError(t, err)
+	defer idle.Close()
+
+	fmt.Fprintf(idle, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(idle), nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// a request in flight while shutting down
+	inFlight := make(chan *http.Response, 1)
+	go func() {
+		resp, err := targetHost("example.com", lb.port)
+		assert.NoError(t, err)
+		inFlight <- resp
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- lb.Shutdown()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// idle connections get closed right away
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err))
+
+	// no new connections are accepted
+	_, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", lb.port))
+	assert.Error(t, err)
+
+	// the request in flight is served
+	resp = <-inFlight
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "slow", string(data))
+	assert.True(t, resp.Close)
+
+	assert.NoError(t, <-shutdown)
+	assert.NoError(t, <-listened)
+}
+
+func TestL7_servesFirstRequestsSentWhileDraining(t *testing.T) {
+	var server = createServer("backend")
+	defer server.Close()
+
+	lb, err := New(Config{
+		DrainTimeout: 2 * time.Second,
+		Backends: map[string]Backend{
+			"*": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	listened := make(chan error, 1)
+	go func() {
+		listened <- lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// a connection whose request is slow to arrive
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", lb.port))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- lb.Shutdown()
+	}()
+
+	time.Sleep(4 * drainPollInterval)
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.NoError(t, err)
+	if err == nil {
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "backend", string(data))
+		assert.True(t, resp.Close)
+	}
+
+	assert.NoError(t, <-shutdown)
+	assert.NoError(t, <-listened)
+}
+
+func TestL7_closesConnectionsAfterDrainTimeout(t *testing.T) {
+	var server = createSlowServer(time.Second)
+	defer server.Close()
+
+	lb, err := New(Config{
+		DrainTimeout: 200 * time.Millisecond,
+		Backends: map[string]Backend{
+			"*": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	listened := make(chan error, 1)
+	go func() {
+		listened <- lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	inFlight := make(chan error, 1)
+	go func() {
+		_, err := targetHost("example.com", lb.port)
+		inFlight <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	assert.Error(t, lb.Shutdown())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Error(t, <-inFlight)
+	assert.NoError(t, <-listened)
+}
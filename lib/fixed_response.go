@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"net/textproto"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DEFAULT_FIXED_RESPONSE_STATUS = fasthttp.StatusOK
+)
+
+// FixedResponse answers the requests with the given status,
+// headers and body instead of forwarding them to servers.
+type FixedResponse struct {
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+
+	headers map[string]string
+}
+
+// prepare fills the fields not specified with their
+// defaults and validates the configuration.
+func (fr *FixedResponse) prepare() (err error) {
+	if fr.Status == 0 {
+		fr.Status = DEFAULT_FIXED_RESPONSE_STATUS
+	}
+
+	if fr.Status < 200 || fr.Status > 599 {
+		err = errors.Errorf(
+			"fixed_response status must be between 200 and 599 (got %d)",
+			fr.Status)
+		return
+	}
+
+	// header names aren't normalized by the server: the
+	// canonical form is the one fasthttp gives a meaning
+	// to (e.g., `Content-Type`).
+	fr.headers = make(map[string]string, len(fr.Headers))
+	for name, value := range fr.Headers {
+		if !isToken(name) {
+			err = errors.Errorf(
+				"invalid header name %q", name)
+			return
+		}
+
+		fr.headers[textproto.CanonicalMIMEHeaderKey(name)] = value
+	}
+
+	return
+}
+
+// write answers the request with the fixed response.
+func (fr *FixedResponse) write(ctx *fasthttp.RequestCtx) {
+	ctx.SetStatusCode(fr.Status)
+	for name, value := range fr.headers {
+		ctx.Response.Header.Set(name, value)
+	}
+	ctx.SetBodyString(fr.Body)
+}
+
+// setFixedResponse makes the route answer the requests
+// with the fixed response `fr` (if any).
+func (r *route) setFixedResponse(fr *FixedResponse) (err error) {
+	if fr == nil {
+		return
+	}
+
+	r.response = new(FixedResponse)
+	*r.response = *fr
+
+	err = r.response.prepare()
+	return
+}
@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestFixedResponse_prepare(t *testing.T) {
+	var fr = FixedResponse{}
+	assert.NoError(t, fr.prepare())
+	assert.Equal(t, DEFAULT_FIXED_RESPONSE_STATUS, fr.Status)
+
+	var testCases = []FixedResponse{
+		{Status: 101},
+		{Status: 600},
+		{Headers: map[string]string{"X Invalid": "value"}},
+	}
+
+	for _, tc := range testCases {
+		assert.Error(t, tc.prepare(), "%+v", tc)
+	}
+}
+
+func TestFixedResponse_write(t *testing.T) {
+	var (
+		ctx fasthttp.RequestCtx
+		fr  = FixedResponse{
+			Status: fasthttp.StatusServiceUnavailable,
+			Headers: map[string]string{
+				"content-type": "application/json",
+				"Retry-After":  "120",
+			},
+			Body: `{"status":"maintenance"}`,
+		}
+	)
+
+	assert.NoError(t, fr.prepare())
+
+	ctx.Response.Header.DisableNormalizing()
+	fr.write(&ctx)
+
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, ctx.Response.StatusCode())
+	assert.Equal(t, "application/json", string(ctx.Response.Header.ContentType()))
+	assert.Equal(t, "120", string(ctx.Response.Header.Peek("Retry-After")))
+	assert.Equal(t, `{"status":"maintenance"}`, string(ctx.Response.Body()))
+}
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	forwardedForHeader   = []byte("X-Forwarded-For")
+	forwardedProtoHeader = []byte("X-Forwarded-Proto")
+	forwardedHostHeader  = []byte("X-Forwarded-Host")
+	forwardedPortHeader  = []byte("X-Forwarded-Port")
+	forwardedHeader      = []byte("Forwarded")
+)
+
+// ForwardedHeaders configures how the requests forwarded to the
+// servers tell about the clients that made them.
+//
+// The address of the client is always appended to
+// `X-Forwarded-For`, and `X-Forwarded-Proto`, `X-Forwarded-Host`
+// and `X-Forwarded-Port` are set to what the client asked for.
+// The values sent by clients within `TrustedProxies` (other
+// proxies in front of l7) are kept, while those sent by anyone
+// else are overwritten. With `Forwarded`, the RFC 7239
+// `Forwarded` header is sent as well.
+type ForwardedHeaders struct {
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	Forwarded      bool     `yaml:"forwarded"`
+
+	trusted []*net.IPNet
+}
+
+// prepare parses the trusted proxies.
+func (fh *ForwardedHeaders) prepare() (err error) {
+	fh.trusted, err = parseCIDRs(fh.TrustedProxies)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid forwarded_headers trusted proxies")
+	}
+
+	return
+}
+
+// trusts tells whether the forwarding headers sent
+// from `addr` can be kept.
+func (fh *ForwardedHeaders) trusts(addr net.Addr) bool {
+	return fh != nil && containsAddr(fh.trusted, addr)
+}
+
+// isToken tells whether the value is made only of the
+// characters allowed in HTTP tokens (e.g., header names).
+func isToken(value string) bool {
+	for _, c := range value {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) &&
+			(c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+
+	return value != ""
+}
+
+// forwardedValue quotes the value of a `Forwarded` parameter
+// when it isn't a token (e.g., IPv6 addresses).
+func forwardedValue(value string) string {
+	if !isToken(value) {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
+// apply sets the forwarding headers of the request
+// about to be sent to the servers.
+func (fh *ForwardedHeaders) apply(ctx *fasthttp.RequestCtx) {
+	var (
+		header  = &ctx.Request.Header
+		trusted = fh.trusts(ctx.RemoteAddr())
+		client  = ctx.RemoteIP().String()
+		host    = string(ctx.Host())
+		proto   = "http"
+	)
+
+	if ctx.IsTLS() {
+		proto = "https"
+	}
+
+	// header names aren't normalized by the server, so the
+	// values sent are looked for (and removed) whatever the
+	// case they were sent with.
+	sent := func(key []byte) (value string) {
+		if trusted {
+			value = peekHeader(header, string(key))
+		}
+		delHeaders(header, func(name string) bool {
+			return name == string(key)
+		})
+		return
+	}
+
+	set := func(key []byte, value string) {
+		if previous := sent(key); previous != "" {
+			value = previous
+		}
+		header.SetBytesK(key, value)
+	}
+
+	forwardedFor := client
+	if previous := sent(forwardedForHeader); previous != "" {
+		forwardedFor = previous + ", " + client
+	}
+	header.SetBytesK(forwardedForHeader, forwardedFor)
+
+	set(forwardedProtoHeader, proto)
+	set(forwardedHostHeader, host)
+	if addr, ok := ctx.LocalAddr().(*net.TCPAddr); ok {
+		set(forwardedPortHeader, strconv.Itoa(addr.Port))
+	}
+
+	if fh == nil || !fh.Forwarded {
+		if !trusted {
+			delHeaders(header, func(name string) bool {
+				return name == string(forwardedHeader)
+			})
+		}
+		return
+	}
+
+	if ctx.RemoteIP().To4() == nil {
+		client = "[" + client + "]"
+	}
+
+	element := "for=" + forwardedValue(client) +
+		";host=" + forwardedValue(host) +
+		";proto=" + proto
+
+	if previous := sent(forwardedHeader); previous != "" {
+		element = previous + ", " + element
+	}
+
+	header.SetBytesK(forwardedHeader, element)
+}
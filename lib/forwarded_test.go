@@ -0,0 +1,244 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+// createHeadersServer creates a server that echoes the headers
+// it receives back as `X-Echo-` response headers.
+func createHeadersServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, values := range r.Header {
+			w.Header()["X-Echo-"+key] = values
+		}
+	}))
+}
+
+func TestForwardedHeaders_apply(t *testing.T) {
+	var (
+		proxy  = &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+		client = &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+		v6     = &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000}
+		local  = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080}
+	)
+
+	var testCases = []struct {
+		desc      string
+		forwarded *ForwardedHeaders
+		remote    net.Addr
+		incoming  map[string]string
+		expected  map[string]string
+	}{
+		{
+			desc:   "defaults",
+			remote: client,
+			expected: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "example.com",
+				"X-Forwarded-Port":  "8080",
+				"Forwarded":         "",
+			},
+		},
+		{
+			desc:   "untrusted values are overwritten",
+			remote: client,
+			forwarded: &ForwardedHeaders{
+				TrustedProxies: []string{"10.0.0.0/8"},
+				Forwarded:      true,
+			},
+			incoming: map[string]string{
+				"X-Forwarded-For":   "1.1.1.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "spoofed.com",
+				"Forwarded":         "for=1.1.1.1",
+			},
+			expected: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "example.com",
+				"Forwarded":         "for=203.0.113.7;host=example.com;proto=http",
+			},
+		},
+		{
+			desc:   "untrusted values are overwritten whatever their case",
+			remote: client,
+			forwarded: &ForwardedHeaders{
+				TrustedProxies: []string{"10.0.0.0/8"},
+				Forwarded:      true,
+			},
+			incoming: map[string]string{
+				"x-forwarded-for":   "6.6.6.6",
+				"x-forwarded-proto": "https",
+				"x-forwarded-host":  "spoofed.com",
+				"forwarded":         "for=6.6.6.6",
+			},
+			expected: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "example.com",
+				"Forwarded":         "for=203.0.113.7;host=example.com;proto=http",
+			},
+		},
+		{
+			desc:   "untrusted forwarded is removed whatever its case",
+			remote: client,
+			incoming: map[string]string{
+				"FORWARDED": "for=1.1.1.1",
+			},
+			expected: map[string]string{
+				"Forwarded": "",
+			},
+		},
+		{
+			desc:   "untrusted forwarded is removed",
+			remote: client,
+			incoming: map[string]string{
+				"Forwarded": "for=1.1.1.1",
+			},
+			expected: map[string]string{
+				"Forwarded": "",
+			},
+		},
+		{
+			desc:   "trusted values are kept",
+			remote: proxy,
+			forwarded: &ForwardedHeaders{
+				TrustedProxies: []string{"10.0.0.0/8"},
+				Forwarded:      true,
+			},
+			incoming: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Port":  "443",
+				"Forwarded":         "for=203.0.113.7;proto=https",
+			},
+			expected: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7, 10.0.0.2",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "example.com",
+				"X-Forwarded-Port":  "443",
+				"Forwarded":         "for=203.0.113.7;proto=https, for=10.0.0.2;host=example.com;proto=http",
+			},
+		},
+		{
+			desc:   "trusted values are kept whatever their case",
+			remote: proxy,
+			forwarded: &ForwardedHeaders{
+				TrustedProxies: []string{"10.0.0.0/8"},
+				Forwarded:      true,
+			},
+			incoming: map[string]string{
+				"x-forwarded-for":   "203.0.113.7",
+				"x-forwarded-proto": "https",
+				"forwarded":         "for=203.0.113.7;proto=https",
+			},
+			expected: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7, 10.0.0.2",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "example.com",
+				"Forwarded":         "for=203.0.113.7;proto=https, for=10.0.0.2;host=example.com;proto=http",
+			},
+		},
+		{
+			desc:      "ipv6 is quoted",
+			remote:    v6,
+			forwarded: &ForwardedHeaders{Forwarded: true},
+			expected: map[string]string{
+				"X-Forwarded-For": "2001:db8::7",
+				"Forwarded":       `for="[2001:db8::7]";host=example.com;proto=http`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if tc.forwarded != nil {
+				assert.NoError(t, tc.forwarded.prepare())
+			}
+
+			var ctx fasthttp.RequestCtx
+			ctx.Init2(&streamConn{local: local, remote: tc.remote},
+				fasthttpLogger{zerolog.Nop()}, false)
+			ctx.Request.Header.DisableNormalizing()
+			ctx.Request.Header.SetHost("example.com")
+			for key, value := range tc.incoming {
+				ctx.Request.Header.Set(key, value)
+			}
+
+			tc.forwarded.apply(&ctx)
+
+			for key, value := range tc.expected {
+				var values []string
+				ctx.Request.Header.VisitAll(func(k, v []byte) {
+					if http.CanonicalHeaderKey(string(k)) == key {
+						values = append(values, string(v))
+					}
+				})
+
+				if value == "" {
+					assert.Empty(t, values, key)
+				} else {
+					assert.Equal(t, []string{value}, values, key)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedHeaders_prepareFailsOnInvalidCIDRs(t *testing.T) {
+	var fh = ForwardedHeaders{TrustedProxies: []string{"10.0.0.1"}}
+	assert.Error(t, fh.prepare())
+}
+
+func TestL7_setsForwardedHeaders(t *testing.T) {
+	var server = createHeadersServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		ForwardedHeaders: &ForwardedHeaders{Forwarded: true},
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d", lb.port), nil)
+	assert.NoError(t, err)
+
+	req.Host = "example.com"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	req.Header["x-forwarded-for"] = []string{"6.6.6.6"}
+	req.Header["x-forwarded-proto"] = []string{"https"}
+	req.Header["x-forwarded-host"] = []string{"spoofed.com"}
+	req.Header["forwarded"] = []string{"for=6.6.6.6"}
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"127.0.0.1"}, resp.Header["X-Echo-X-Forwarded-For"])
+	assert.Equal(t, []string{"http"}, resp.Header["X-Echo-X-Forwarded-Proto"])
+	assert.Equal(t, []string{"example.com"}, resp.Header["X-Echo-X-Forwarded-Host"])
+	assert.Equal(t, fmt.Sprint(lb.port), resp.Header.Get("X-Echo-X-Forwarded-Port"))
+	assert.Equal(t, []string{"for=127.0.0.1;host=example.com;proto=http"},
+		resp.Header["X-Echo-Forwarded"])
+}
@@ -0,0 +1,251 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	PROTOCOL_HTTP = "http"
+	PROTOCOL_GRPC = "grpc"
+
+	DEFAULT_PROTOCOL = PROTOCOL_HTTP
+
+	grpcContentType = "application/grpc"
+	grpcBufferSize  = 32 * 1024
+)
+
+// gRPC status codes that requests can be failed with.
+const (
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// validateProtocol checks whether the servers of a backend
+// can be spoken to with the given protocol.
+func validateProtocol(protocol string) (err error) {
+	switch protocol {
+	case PROTOCOL_HTTP, PROTOCOL_GRPC:
+	default:
+		err = errors.Errorf(
+			"unknown protocol %s", protocol)
+	}
+
+	return
+}
+
+// isGRPC tells whether a content type is one of the
+// gRPC ones (`application/grpc`, `application/grpc+proto`, ...).
+func isGRPC(contentType string) bool {
+	if !strings.HasPrefix(contentType, grpcContentType) {
+		return false
+	}
+
+	rest := contentType[len(grpcContentType):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// grpcStatus maps the statuses of the responses given by `l7`
+// itself to gRPC status codes.
+func grpcStatus(status int) int {
+	switch status {
+	case fasthttp.StatusBadRequest:
+		return grpcInternal
+	case fasthttp.StatusUnauthorized:
+		return grpcUnauthenticated
+	case fasthttp.StatusForbidden:
+		return grpcPermissionDenied
+	case fasthttp.StatusNotFound:
+		return grpcUnimplemented
+	case fasthttp.StatusTooManyRequests,
+		fasthttp.StatusBadGateway,
+		fasthttp.StatusServiceUnavailable,
+		fasthttp.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+
+	return grpcUnknown
+}
+
+// writeGRPCError answers a gRPC request with a trailers-only
+// response carrying the status equivalent to the HTTP one.
+func writeGRPCError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", grpcContentType)
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatus(status)))
+	w.Header().Set("Grpc-Message", strings.ToLower(fasthttp.StatusMessage(status)))
+	w.WriteHeader(http.StatusOK)
+}
+
+// newGRPCTransport creates the transport used to speak HTTP/2
+// to the servers: over TLS if `ut` is given, in cleartext (h2c
+// with prior knowledge) otherwise.
+func newGRPCTransport(ut *UpstreamTLS) (t *http.Transport) {
+	t = &http.Transport{
+		Protocols:           new(http.Protocols),
+		TLSHandshakeTimeout: fasthttp.DefaultLBClientTimeout,
+	}
+
+	if ut != nil {
+		t.TLSClientConfig = ut.config
+		t.Protocols.SetHTTP2(true)
+	} else {
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return
+}
+
+// grpcRequest creates the request forwarded to the upstream
+// out of the one (possibly modified) by `l7`.
+func (u *upstream) grpcRequest(ctx *fasthttp.RequestCtx, stream *h2Stream) (req *http.Request, err error) {
+	var body io.Reader = stream.r.Body
+	if stream.bodyRead {
+		body = bytes.NewReader(ctx.Request.Body())
+	}
+
+	req, err = http.NewRequestWithContext(stream.r.Context(),
+		string(ctx.Method()),
+		u.scheme()+"://"+u.address+string(ctx.URI().RequestURI()),
+		body)
+	if err != nil {
+		return
+	}
+
+	if !stream.bodyRead {
+		req.ContentLength = stream.r.ContentLength
+	}
+
+	req.Host = string(ctx.Host())
+	ctx.Request.Header.VisitAll(func(key, value []byte) {
+		name := http.CanonicalHeaderKey(string(key))
+		if name != "Host" && name != "Content-Length" && !hopByHopHeaders[name] {
+			req.Header.Add(name, string(value))
+		}
+	})
+
+	// gRPC servers rely on it to tell whether the
+	// proxies in between support trailers.
+	req.Header.Set("Te", "trailers")
+
+	return
+}
+
+// proxyGRPC forwards the request to one of the healthy upstreams
+// over HTTP/2, streaming the messages in both directions and
+// relaying the trailers (where the gRPC status lives).
+//
+// Only requests received over HTTP/2 can be forwarded.
+func (lb *L7) proxyGRPC(ctx *fasthttp.RequestCtx, p *pool) (err error) {
+	stream, ok := ctx.UserValue(h2StreamKey).(*h2Stream)
+	if !ok {
+		ctx.SetStatusCode(fasthttp.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	u, _, err := p.choose(ctx)
+	if err != nil {
+		return
+	}
+
+	p.rewriteRequest(ctx, u)
+	req, err := u.grpcRequest(ctx, stream)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't create grpc request to %s", u.address)
+		return
+	}
+
+	start := time.Now()
+	resp, err := u.transport.RoundTrip(req)
+	if err != nil {
+		p.report(u, time.Since(start), true)
+		err = errors.Wrapf(err,
+			"couldn't forward grpc request to %s", u.address)
+		return
+	}
+	defer resp.Body.Close()
+
+	stream.answered = true
+	for name, values := range resp.Header {
+		if !hopByHopHeaders[name] {
+			stream.w.Header()[name] = values
+		}
+	}
+	p.rewriteResponse(stream.w.Header(), ctx, u)
+	stream.w.Header().Set(lb.requestID.Header, requestIDOf(ctx))
+	stream.w.WriteHeader(resp.StatusCode)
+
+	// the headers go right away as the server may only
+	// send messages once the client does.
+	http.NewResponseController(stream.w).Flush()
+
+	err = relay(stream.w, resp.Body)
+
+	// trailers are only known once the body is over.
+	for name, values := range resp.Trailer {
+		stream.w.Header()[http.TrailerPrefix+name] = values
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+
+	if err != nil && status == "" {
+		status = strconv.Itoa(grpcUnavailable)
+		stream.w.Header().Set(http.TrailerPrefix+"Grpc-Status", status)
+		stream.w.Header().Set(http.TrailerPrefix+"Grpc-Message", "upstream stream failed")
+		err = errors.Wrapf(err,
+			"couldn't relay grpc response from %s", u.address)
+	} else {
+		err = nil
+	}
+
+	p.report(u, time.Since(start),
+		resp.StatusCode >= 500 || status == strconv.Itoa(grpcUnavailable))
+	return
+}
+
+// relay copies the body of a response flushing each chunk
+// right away so that streamed messages aren't held back.
+func relay(w http.ResponseWriter, body io.Reader) (err error) {
+	var (
+		buf = make([]byte, grpcBufferSize)
+		rc  = http.NewResponseController(w)
+		n   int
+	)
+
+	for {
+		n, err = body.Read(buf)
+		if n > 0 {
+			_, werr := w.Write(buf[:n])
+			if werr == nil {
+				werr = rc.Flush()
+			}
+			if werr != nil {
+				err = werr
+				return
+			}
+		}
+
+		if err == io.EOF {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// grpcHandler emulates a gRPC service echoing each message
+// as soon as it's received, finishing with the status
+// in the trailers.
+var grpcHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if !isGRPC(r.Header.Get("Content-Type")) {
+		w.WriteHeader(415)
+		return
+	}
+
+	w.Header().Set("Content-Type", grpcContentType)
+	w.Header().Set("X-Host", r.Host)
+	w.Header().Set("X-Path", r.URL.Path)
+	if r.URL.Path == "/echo.Echo/Fail" {
+		w.Header().Set("Grpc-Status", "5")
+		w.WriteHeader(200)
+		return
+	}
+
+	w.WriteHeader(200)
+	http.NewResponseController(w).Flush()
+
+	var (
+		buf      = make([]byte, 1024)
+		messages int
+	)
+
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			messages++
+			w.Write(buf[:n])
+			http.NewResponseController(w).Flush()
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	w.Header().Set(http.TrailerPrefix+"X-Messages", fmt.Sprint(messages))
+})
+
+// createGRPCServer creates a server speaking h2c
+// with prior knowledge.
+func createGRPCServer() *httptest.Server {
+	server := httptest.NewUnstartedServer(grpcHandler)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+func grpcCall(client *http.Client, url, host string, body io.Reader) (resp *http.Response, err error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return
+	}
+
+	req.Host = host
+	req.Header.Set("Content-Type", grpcContentType+"+proto")
+	req.Header.Set("Te", "trailers")
+
+	resp, err = client.Do(req)
+	return
+}
+
+func TestIsGRPC(t *testing.T) {
+	var testCases = map[string]bool{
+		"":                              false,
+		"application/json":              false,
+		"application/grpc":              true,
+		"application/grpc+proto":        true,
+		"application/grpc; charset=utf": true,
+		"application/grpc-web":          false,
+		"application/grpcx":             false,
+	}
+
+	for contentType, expected := range testCases {
+		assert.Equal(t, expected, isGRPC(contentType), contentType)
+	}
+}
+
+func TestL7_proxiesGRPCStreams(t *testing.T) {
+	var server = createGRPCServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		HTTP2: &HTTP2{H2C: true},
+		Backends: map[string]Backend{
+			"grpc.com": Backend{
+				Protocol: PROTOCOL_GRPC,
+				Servers:  []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var (
+		url    = fmt.Sprintf("http://localhost:%d/echo.Echo/Chat", lb.port)
+		client = http2Client(func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) })
+		pr, pw = io.Pipe()
+	)
+
+	resp, err := grpcCall(client, url, "grpc.com", pr)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "grpc.com", resp.Header.Get("X-Host"))
+
+	// each message is echoed back before the next is sent
+	for _, message := range []string{"first", "second"} {
+		fmt.Fprint(pw, message)
+
+		buf := make([]byte, len(message))
+		_, err = io.ReadFull(resp.Body, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, message, string(buf))
+	}
+
+	pw.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "2", resp.Trailer.Get("X-Messages"))
+
+	// trailers-only responses are relayed as well
+	resp, err = grpcCall(client, fmt.Sprintf("http://localhost:%d/echo.Echo/Fail", lb.port),
+		"grpc.com", strings.NewReader("message"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "5", resp.Header.Get("Grpc-Status"))
+}
+
+func TestL7_rewritesGRPCPaths(t *testing.T) {
+	var server = createGRPCServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		HTTP2: &HTTP2{H2C: true},
+		Backends: map[string]Backend{
+			"grpc.com": Backend{
+				Protocol: PROTOCOL_GRPC,
+				Servers:  []Server{{Address: server.URL}},
+				Routes: []Route{{
+					Prefix:  "/v1",
+					Servers: []Server{{Address: server.URL}},
+					Rewrite: &Rewrite{StripPrefix: "/v1"},
+				}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var client = http2Client(func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) })
+
+	resp, err := grpcCall(client, fmt.Sprintf("http://localhost:%d/v1/echo.Echo/Chat", lb.port),
+		"grpc.com", strings.NewReader("message"))
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "/echo.Echo/Chat", resp.Header.Get("X-Path"))
+	assert.Equal(t, "message", string(data))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestL7_answersGRPCErrorsWithGRPCStatuses(t *testing.T) {
+	var (
+		server = createGRPCServer()
+		closed = createGRPCServer()
+	)
+	defer server.Close()
+	closed.Close()
+
+	lb, err := New(Config{
+		HTTP2: &HTTP2{H2C: true},
+		Users: map[string]string{"user": "pass"},
+		Backends: map[string]Backend{
+			"grpc.com": Backend{
+				Protocol: PROTOCOL_GRPC,
+				Servers:  []Server{{Address: server.URL}},
+			},
+			"down.com": Backend{
+				Protocol: PROTOCOL_GRPC,
+				Servers:  []Server{{Address: closed.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var (
+		url    = fmt.Sprintf("http://localhost:%d/echo.Echo/Chat", lb.port)
+		client = http2Client(func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) })
+	)
+
+	var testCases = []struct {
+		host          string
+		authenticated bool
+		status        string
+	}{
+		{"grpc.com", false, "16"},
+		{"grpc.com", true, "0"},
+		{"unknown.com", true, "12"},
+		{"down.com", true, "14"},
+	}
+
+	for _, tc := range testCases {
+		req, err := http.NewRequest("POST", url, strings.NewReader("message"))
+		assert.NoError(t, err)
+
+		req.Host = tc.host
+		req.Header.Set("Content-Type", grpcContentType)
+		if tc.authenticated {
+			req.SetBasicAuth("user", "pass")
+		}
+
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		status := resp.Header.Get("Grpc-Status")
+		if status == "" {
+			status = resp.Trailer.Get("Grpc-Status")
+		}
+
+		assert.Equal(t, 200, resp.StatusCode, tc.host)
+		assert.Equal(t, tc.status, status, tc.host)
+	}
+
+	// gRPC can't be forwarded from HTTP/1.x clients
+	req, err := http.NewRequest("POST", url, strings.NewReader("message"))
+	assert.NoError(t, err)
+	req.Host = "grpc.com"
+	req.SetBasicAuth("user", "pass")
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 505, resp.StatusCode)
+}
+
+func TestL7_proxiesGRPCToTLSServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l7-grpc")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewUnstartedServer(grpcHandler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	cert, key := createCertificate(t, dir, "default")
+
+	lb, err := New(Config{
+		TLS:   &TLS{Cert: cert, Key: key},
+		HTTP2: &HTTP2{},
+		Backends: map[string]Backend{
+			"grpc.com": Backend{
+				Protocol:    PROTOCOL_GRPC,
+				UpstreamTLS: &UpstreamTLS{InsecureSkipVerify: true},
+				Servers:     []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	lb.tlsPort = 0
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var client = http2Client(func(p *http.Protocols) { p.SetHTTP2(true) })
+
+	resp, err := grpcCall(client, fmt.Sprintf("https://localhost:%d/echo.Echo/Chat", lb.tlsPort),
+		"grpc.com", strings.NewReader("message"))
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "message", string(data))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestUpstream_probesGRPCServers(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	address, err := NormalizeAddress(server.URL)
+	assert.NoError(t, err)
+
+	var hc = &HealthCheck{}
+	assert.NoError(t, hc.prepare())
+
+	u := newUpstream(address, nil)
+	assert.False(t, u.probe(hc))
+
+	u.transport = newGRPCTransport(nil)
+	assert.True(t, u.probe(hc))
+}
+
+func TestLoadBackends_failsOnUnknownProtocol(t *testing.T) {
+	_, err := New(Config{
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Protocol: "spdy",
+				Servers:  []Server{{Address: "http://localhost:8080"}},
+			},
+		},
+	})
+	assert.Error(t, err)
+}
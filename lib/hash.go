@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	ALGORITHM_CONSISTENT_HASH = "consistent-hash"
+
+	HASH_ON_IP     = "ip"
+	HASH_ON_PATH   = "path"
+	HASH_ON_HEADER = "header:"
+	HASH_ON_COOKIE = "cookie:"
+
+	DEFAULT_HASH_ON = HASH_ON_IP
+
+	// ringReplicas is the number of points that each unit
+	// of weight of an upstream occupies in the ring.
+	ringReplicas = 160
+)
+
+// hashKeyFunc extracts from a request the key used to
+// select an upstream.
+type hashKeyFunc func(ctx *fasthttp.RequestCtx) []byte
+
+// newHashKeyFunc creates the function that extracts the request
+// attribute described by `hashOn`:
+//
+//	ip            remote address of the client
+//	path          path of the request
+//	header:NAME   value of the header NAME
+//	cookie:NAME   value of the cookie NAME
+//
+// Requests lacking the attribute are hashed by their client
+// address.
+func newHashKeyFunc(hashOn string) (f hashKeyFunc, err error) {
+	var name string
+
+	switch {
+	case hashOn == "" || hashOn == HASH_ON_IP:
+		f = hashOnIP
+		return
+	case hashOn == HASH_ON_PATH:
+		f = func(ctx *fasthttp.RequestCtx) []byte {
+			return ctx.Path()
+		}
+		return
+	case strings.HasPrefix(hashOn, HASH_ON_HEADER):
+		name = hashOn[len(HASH_ON_HEADER):]
+		// header names aren't normalized by the server, so
+		// the header is looked for whatever its case.
+		canonical := http.CanonicalHeaderKey(name)
+		f = func(ctx *fasthttp.RequestCtx) []byte {
+			return orHashOnIP(ctx, []byte(peekHeader(&ctx.Request.Header, canonical)))
+		}
+	case strings.HasPrefix(hashOn, HASH_ON_COOKIE):
+		name = hashOn[len(HASH_ON_COOKIE):]
+		f = func(ctx *fasthttp.RequestCtx) []byte {
+			return orHashOnIP(ctx, ctx.Request.Header.Cookie(name))
+		}
+	default:
+		err = errors.Errorf(
+			"unknown hash attribute %s (available: %s, %s, %sNAME, %sNAME)",
+			hashOn, HASH_ON_IP, HASH_ON_PATH, HASH_ON_HEADER, HASH_ON_COOKIE)
+		return
+	}
+
+	if name == "" {
+		err = errors.Errorf(
+			"hash attribute %s must specify a name", hashOn)
+		return
+	}
+
+	return
+}
+
+func hashOnIP(ctx *fasthttp.RequestCtx) []byte {
+	return ctx.RemoteIP()
+}
+
+// hashOnAddr is the key of the connections balanced without
+// seeing their requests (e.g., TCP or TLS passthrough ones):
+// the address of the client.
+func hashOnAddr(addr net.Addr) []byte {
+	host, _, _ := net.SplitHostPort(addr.String())
+	return []byte(host)
+}
+
+func orHashOnIP(ctx *fasthttp.RequestCtx, key []byte) []byte {
+	if len(key) == 0 {
+		return hashOnIP(ctx)
+	}
+
+	return key
+}
+
+func hash(key []byte) uint64 {
+	var h = fnv.New64a()
+
+	h.Write(key)
+
+	// fnv doesn't spread well keys that only differ in
+	// their last bytes - finalize it as splitmix64 does.
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+type ringPoint struct {
+	hash     uint64
+	upstream *upstream
+}
+
+// consistentHash places the upstreams in a hash ring (by their
+// addresses) so that adding or removing servers only remaps
+// the keys that were (or will be) assigned to them.
+//
+// Keys are assigned to the first available upstream found
+// clockwise from their position in the ring.
+type consistentHash struct {
+	ring []ringPoint
+}
+
+func newConsistentHash(upstreams []*upstream, weights []int) balancer {
+	var b = &consistentHash{}
+
+	for ndx, u := range upstreams {
+		for i := 0; i < ringReplicas*weights[ndx]; i++ {
+			b.ring = append(b.ring, ringPoint{
+				hash:     hash([]byte(u.address + "-" + strconv.Itoa(i))),
+				upstream: u,
+			})
+		}
+	}
+
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+
+	return b
+}
+
+func (b *consistentHash) pick(candidates []*upstream, key []byte) *upstream {
+	var (
+		h     = hash(key)
+		start = sort.Search(len(b.ring), func(i int) bool {
+			return b.ring[i].hash >= h
+		})
+	)
+
+	for i := 0; i < len(b.ring); i++ {
+		point := b.ring[(start+i)%len(b.ring)]
+		for _, candidate := range candidates {
+			if candidate == point.upstream {
+				return candidate
+			}
+		}
+	}
+
+	return candidates[0]
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestNewHashKeyFunc(t *testing.T) {
+	var ip = string(net.ParseIP("10.0.0.1").To4())
+
+	var testCases = []struct {
+		hashOn      string
+		key         string
+		shouldError bool
+	}{
+		{"", ip, false},
+		{"ip", ip, false},
+		{"path", "/users/1", false},
+		{"header:X-User", "john", false},
+		{"header:x-user", "john", false},
+		{"header:X-Tenant", "acme", false},
+		{"header:X-Missing", ip, false},
+		{"cookie:session", "abc", false},
+		{"cookie:missing", ip, false},
+		{"header:", "", true},
+		{"cookie:", "", true},
+		{"something", "", true},
+	}
+
+	var ctx = &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.IP(ip)}, nil)
+	ctx.Request.Header.DisableNormalizing()
+	ctx.Request.SetRequestURI("/users/1?a=b")
+	ctx.Request.Header.Set("X-User", "john")
+	ctx.Request.Header.Set("x-tenant", "acme")
+	ctx.Request.Header.SetCookie("session", "abc")
+
+	for _, tc := range testCases {
+		t.Run(tc.hashOn, func(t *testing.T) {
+			f, err := newHashKeyFunc(tc.hashOn)
+			assert.Equal(t, tc.shouldError, err != nil)
+			if !tc.shouldError {
+				assert.Equal(t, tc.key, string(f(ctx)))
+			}
+		})
+	}
+}
+
+func TestConsistentHash_pickIsStable(t *testing.T) {
+	var (
+		upstreams = upstreamsFor("a:80", "b:80", "c:80")
+		b         = newConsistentHash(upstreams, []int{1, 1, 1})
+		picks     = make(map[string]int)
+	)
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		u := b.pick(upstreams, key)
+		assert.Equal(t, u, b.pick(upstreams, key))
+		picks[u.address]++
+	}
+
+	for _, u := range upstreams {
+		assert.InDelta(t, 333, picks[u.address], 100, u.address)
+	}
+}
+
+func TestConsistentHash_minimizesRemapping(t *testing.T) {
+	var (
+		before   = upstreamsFor("a:80", "b:80", "c:80")
+		after    = append(upstreamsFor("a:80", "b:80", "c:80"), newUpstream("d:80", nil))
+		bBefore  = newConsistentHash(before, []int{1, 1, 1})
+		bAfter   = newConsistentHash(after, []int{1, 1, 1, 1})
+		remapped = 0
+	)
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		previous := bBefore.pick(before, key).address
+		current := bAfter.pick(after, key).address
+
+		if previous != current {
+			assert.Equal(t, "d:80", current)
+			remapped++
+		}
+	}
+
+	assert.InDelta(t, 250, remapped, 100)
+}
+
+func TestConsistentHash_skipsUnavailableUpstreams(t *testing.T) {
+	var (
+		upstreams = upstreamsFor("a:80", "b:80", "c:80")
+		b         = newConsistentHash(upstreams, []int{1, 1, 1})
+	)
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		u := b.pick(upstreams, key)
+		if u.address == "a:80" {
+			continue
+		}
+
+		// keys not assigned to the missing upstream
+		// keep their assignment.
+		assert.Equal(t, u, b.pick(upstreams[1:], key))
+	}
+}
@@ -0,0 +1,305 @@
+package lib
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+// requestVariables are the variables standing for properties
+// of the request itself.
+var requestVariables = map[string]bool{
+	"client_ip":  true,
+	"host":       true,
+	"scheme":     true,
+	"method":     true,
+	"path":       true,
+	"request_id": true,
+}
+
+// headerVariables are the variables that can be used
+// within the values of the header rules.
+var headerVariables = map[string]bool{
+	"client_ip":  true,
+	"host":       true,
+	"scheme":     true,
+	"method":     true,
+	"path":       true,
+	"backend":    true,
+	"route":      true,
+	"server":     true,
+	"request_id": true,
+}
+
+// HeaderRules modifies the headers of the requests sent to the
+// servers (or of the responses they send back).
+//
+// Headers in `Remove` are removed first, then those in `Set`
+// are replaced and finally those in `Add` are appended. Values
+// can make use of variables (e.g., `${client_ip}`) which are
+// replaced by what they stand for in each request.
+type HeaderRules struct {
+	Add    map[string]string `yaml:"add"`
+	Set    map[string]string `yaml:"set"`
+	Remove []string          `yaml:"remove"`
+}
+
+// headerTemplate is a header value split into the literal
+// text and the variables it's made of.
+type headerTemplate []templatePart
+
+type templatePart struct {
+	literal  string
+	variable string
+}
+
+type headerValue struct {
+	name  string
+	value headerTemplate
+}
+
+// headerRewrite is the compiled form of HeaderRules.
+type headerRewrite struct {
+	remove []string
+	set    []headerValue
+	add    []headerValue
+}
+
+// headerEditor is implemented by the headers of both fasthttp
+// requests and responses as well as by http.Header.
+type headerEditor interface {
+	Add(key, value string)
+	Set(key, value string)
+	Del(key string)
+}
+
+// parseHeaderTemplate splits a value into literal text and
+// `${variable}` references, making sure the variables exist.
+func parseHeaderTemplate(value string) (tmpl headerTemplate, err error) {
+	return parseTemplate(value, func(name string) bool {
+		return headerVariables[name]
+	})
+}
+
+// parseTemplate splits a value into literal text and
+// `${variable}` references, the variables being those
+// accepted by `valid`.
+func parseTemplate(value string, valid func(name string) bool) (tmpl headerTemplate, err error) {
+	for value != "" {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			tmpl = append(tmpl, templatePart{literal: value})
+			return
+		}
+
+		if start > 0 {
+			tmpl = append(tmpl, templatePart{literal: value[:start]})
+		}
+
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			err = errors.Errorf(
+				"unterminated variable in %q", value)
+			return
+		}
+
+		name := value[start+2 : start+end]
+		if !valid(name) {
+			err = errors.Errorf(
+				"unknown variable %s", name)
+			return
+		}
+
+		tmpl = append(tmpl, templatePart{variable: name})
+		value = value[start+end+1:]
+	}
+
+	return
+}
+
+func (tmpl headerTemplate) render(lookup func(variable string) string) string {
+	if len(tmpl) == 1 && tmpl[0].variable == "" {
+		return tmpl[0].literal
+	}
+
+	var b strings.Builder
+	for _, part := range tmpl {
+		if part.variable != "" {
+			b.WriteString(lookup(part.variable))
+		} else {
+			b.WriteString(part.literal)
+		}
+	}
+
+	return b.String()
+}
+
+func parseHeaderValues(values map[string]string) (parsed []headerValue, err error) {
+	for name, value := range values {
+		if !isToken(name) {
+			err = errors.Errorf(
+				"invalid header name %q", name)
+			return
+		}
+
+		var tmpl headerTemplate
+		tmpl, err = parseHeaderTemplate(value)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"invalid value of header %s", name)
+			return
+		}
+
+		parsed = append(parsed, headerValue{name: name, value: tmpl})
+	}
+
+	// maps don't keep the order of the rules: sorting
+	// makes it consistent across requests at least.
+	sort.Slice(parsed, func(i, j int) bool {
+		return parsed[i].name < parsed[j].name
+	})
+
+	return
+}
+
+// compileHeaderRules compiles the sets of rules given (the
+// nil ones being skipped) to be applied in order.
+func compileHeaderRules(rules ...*HeaderRules) (rewrites []*headerRewrite, err error) {
+	for _, hr := range rules {
+		if hr == nil {
+			continue
+		}
+
+		var rewrite = &headerRewrite{}
+
+		for _, name := range hr.Remove {
+			if !isToken(name) {
+				err = errors.Errorf(
+					"invalid header name %q", name)
+				return
+			}
+
+			rewrite.remove = append(rewrite.remove, name)
+		}
+
+		rewrite.set, err = parseHeaderValues(hr.Set)
+		if err != nil {
+			return
+		}
+
+		rewrite.add, err = parseHeaderValues(hr.Add)
+		if err != nil {
+			return
+		}
+
+		rewrites = append(rewrites, rewrite)
+	}
+
+	return
+}
+
+func (hr *headerRewrite) apply(h headerEditor, lookup func(variable string) string) {
+	// header names of the requests aren't normalized by the
+	// server, so fasthttp headers are removed whatever the
+	// case they were sent with.
+	del := h.Del
+	if fh, ok := h.(fasthttpHeader); ok {
+		del = func(key string) {
+			key = http.CanonicalHeaderKey(key)
+			delHeaders(fh, func(name string) bool {
+				return name == key
+			})
+		}
+	}
+
+	for _, name := range hr.remove {
+		del(name)
+	}
+
+	for _, v := range hr.set {
+		del(v.name)
+		h.Set(v.name, v.value.render(lookup))
+	}
+
+	for _, v := range hr.add {
+		h.Add(v.name, v.value.render(lookup))
+	}
+}
+
+// headerVariable retrieves the value of a header variable
+// for a request forwarded to the upstream `u`.
+func (p *pool) headerVariable(ctx *fasthttp.RequestCtx, u *upstream) func(string) string {
+	return func(variable string) string {
+		switch variable {
+		case "backend":
+			return p.backend
+		case "route":
+			return p.route
+		case "server":
+			return u.address
+		}
+
+		return requestVariable(ctx, variable)
+	}
+}
+
+// requestVariable retrieves the value of one of the
+// requestVariables for the request of `ctx`.
+func requestVariable(ctx *fasthttp.RequestCtx, variable string) string {
+	switch variable {
+	case "client_ip":
+		return ctx.RemoteIP().String()
+	case "host":
+		return string(hostWithoutPort(ctx.Host()))
+	case "scheme":
+		if ctx.IsTLS() {
+			return "https"
+		}
+		return "http"
+	case "method":
+		return string(ctx.Method())
+	case "path":
+		return string(ctx.Path())
+	case "request_id":
+		return requestIDOf(ctx)
+	}
+
+	return ""
+}
+
+// rewriteRequest applies the request header rules (and the
+// `Host` rewrite) to the request about to be forwarded to `u`.
+func (p *pool) rewriteRequest(ctx *fasthttp.RequestCtx, u *upstream) {
+	if p.serverHost {
+		// fasthttp writes the host of the URI instead of
+		// the header once the URI got parsed (e.g., after
+		// the path has been rewritten).
+		ctx.Request.Header.SetHost(u.address)
+		ctx.URI().SetHost(u.address)
+	}
+
+	if len(p.requestHeaders) == 0 {
+		return
+	}
+
+	lookup := p.headerVariable(ctx, u)
+	for _, hr := range p.requestHeaders {
+		hr.apply(&ctx.Request.Header, lookup)
+	}
+}
+
+// rewriteResponse applies the response header rules to the
+// headers `h` of the response sent back by `u`.
+func (p *pool) rewriteResponse(h headerEditor, ctx *fasthttp.RequestCtx, u *upstream) {
+	if len(p.responseHeaders) == 0 {
+		return
+	}
+
+	lookup := p.headerVariable(ctx, u)
+	for _, hr := range p.responseHeaders {
+		hr.apply(h, lookup)
+	}
+}
@@ -0,0 +1,183 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseHeaderTemplate(t *testing.T) {
+	var lookup = func(variable string) string {
+		return "<" + variable + ">"
+	}
+
+	var testCases = []struct {
+		value       string
+		expected    string
+		shouldError bool
+	}{
+		{"", "", false},
+		{"DENY", "DENY", false},
+		{"${client_ip}", "<client_ip>", false},
+		{"${backend}/${route} -> ${server}", "<backend>/<route> -> <server>", false},
+		{"id=${request_id};", "id=<request_id>;", false},
+		{"$ and {}", "$ and {}", false},
+		{"${unknown}", "", true},
+		{"${host", "", true},
+	}
+
+	for _, tc := range testCases {
+		tmpl, err := parseHeaderTemplate(tc.value)
+		if tc.shouldError {
+			assert.Error(t, err, tc.value)
+			continue
+		}
+
+		assert.NoError(t, err, tc.value)
+		assert.Equal(t, tc.expected, tmpl.render(lookup), tc.value)
+	}
+}
+
+func TestCompileHeaderRules_failsOnInvalidRules(t *testing.T) {
+	var testCases = []*HeaderRules{
+		{Remove: []string{"X Invalid"}},
+		{Set: map[string]string{"X:Invalid": "value"}},
+		{Add: map[string]string{"X-Valid": "${nope}"}},
+	}
+
+	for _, tc := range testCases {
+		_, err := compileHeaderRules(tc)
+		assert.Error(t, err, "%+v", tc)
+	}
+}
+
+func TestHeaderRewrite_apply(t *testing.T) {
+	rewrites, err := compileHeaderRules(
+		&HeaderRules{
+			Remove: []string{"X-Removed", "X-Replaced"},
+			Set:    map[string]string{"X-Replaced": "new", "X-Tenant": "backend"},
+		},
+		&HeaderRules{
+			Set: map[string]string{"X-Tenant": "route"},
+			Add: map[string]string{"X-Added": "${method} ${path}"},
+		})
+	assert.NoError(t, err)
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.DisableNormalizing()
+	ctx.Request.SetRequestURI("/api/users")
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.Set("X-Removed", "value")
+	ctx.Request.Header.Set("x-removed", "value")
+	ctx.Request.Header.Set("X-Replaced", "old")
+	ctx.Request.Header.Set("x-replaced", "old")
+	ctx.Request.Header.Set("x-tenant", "victim")
+	ctx.Request.Header.Set("X-Added", "first")
+
+	var p = &pool{requestHeaders: rewrites}
+	p.rewriteRequest(&ctx, &upstream{address: "localhost:8080"})
+
+	var values = map[string][]string{}
+	ctx.Request.Header.VisitAll(func(key, value []byte) {
+		name := http.CanonicalHeaderKey(string(key))
+		values[name] = append(values[name], string(value))
+	})
+
+	assert.Empty(t, values["X-Removed"])
+	assert.Equal(t, []string{"new"}, values["X-Replaced"])
+	assert.Equal(t, []string{"route"}, values["X-Tenant"])
+	assert.Equal(t, []string{"first", "POST /api/users"}, values["X-Added"])
+}
+
+func TestL7_rewritesHeaders(t *testing.T) {
+	var server = createHeadersServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+				RequestHeaders: &HeaderRules{
+					Set:    map[string]string{"X-Tenant": "acme"},
+					Add:    map[string]string{"X-Via": "${backend} ${route} ${server} ${client_ip}"},
+					Remove: []string{"X-Internal"},
+				},
+				ResponseHeaders: &HeaderRules{
+					Set: map[string]string{"X-Frame-Options": "DENY"},
+				},
+				Routes: []Route{
+					{
+						Prefix:  "/api",
+						Servers: []Server{{Address: server.URL}},
+						RequestHeaders: &HeaderRules{
+							Set: map[string]string{"X-Tenant": "api"},
+						},
+						ResponseHeaders: &HeaderRules{
+							Remove: []string{"X-Echo-X-Via"},
+						},
+					},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	get := func(path string) (resp *http.Response) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d%s", lb.port, path), nil)
+		assert.NoError(t, err)
+
+		req.Host = "example.com"
+		req.Header.Set("X-Internal", "secret")
+		req.Header["x-internal"] = []string{"secret"}
+		req.Header["x-tenant"] = []string{"victim"}
+
+		resp, err = http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return
+	}
+
+	// variables are replaced by their values
+	resp := get("/")
+	assert.Equal(t, []string{"acme"}, resp.Header["X-Echo-X-Tenant"])
+	assert.Empty(t, resp.Header["X-Echo-X-Internal"])
+	assert.Equal(t, fmt.Sprintf("example.com * %s 127.0.0.1", server.Listener.Addr()),
+		resp.Header.Get("X-Echo-X-Via"))
+	assert.Equal(t, "DENY", resp.Header.Get("X-Frame-Options"))
+
+	// the rules of the route come after those of the backend
+	resp = get("/api")
+	assert.Equal(t, []string{"api"}, resp.Header["X-Echo-X-Tenant"])
+	assert.Empty(t, resp.Header.Get("X-Echo-X-Via"))
+	assert.Equal(t, "DENY", resp.Header.Get("X-Frame-Options"))
+}
+
+func TestLoadBackends_failsOnInvalidHeaderRules(t *testing.T) {
+	var lb = L7{}
+
+	assert.Error(t, lb.LoadBackends(map[string]Backend{
+		"example.com": Backend{
+			RequestHeaders: &HeaderRules{Set: map[string]string{"X-Tenant": "${tenant}"}},
+		},
+	}))
+
+	assert.Error(t, lb.LoadBackends(map[string]Backend{
+		"example.com": Backend{
+			Routes: []Route{{
+				Path:            "/",
+				ResponseHeaders: &HeaderRules{Remove: []string{"X Invalid"}},
+			}},
+		},
+	}))
+}
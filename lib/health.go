@@ -0,0 +1,225 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DEFAULT_HEALTH_CHECK_PATH                = "/"
+	DEFAULT_HEALTH_CHECK_INTERVAL            = 10 * time.Second
+	DEFAULT_HEALTH_CHECK_TIMEOUT             = 2 * time.Second
+	DEFAULT_HEALTH_CHECK_EXPECTED_STATUS     = "200-399"
+	DEFAULT_HEALTH_CHECK_HEALTHY_THRESHOLD   = 2
+	DEFAULT_HEALTH_CHECK_UNHEALTHY_THRESHOLD = 3
+)
+
+// HealthCheck configures the active probing of the
+// servers of a backend.
+//
+// Servers start healthy and are removed from rotation once
+// `UnhealthyThreshold` consecutive probes fail, getting back
+// to it after `HealthyThreshold` consecutive successful ones.
+type HealthCheck struct {
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	ExpectedStatus     string        `yaml:"expected_status"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+
+	minStatus int
+	maxStatus int
+}
+
+// prepare fills the fields not specified with their
+// defaults and validates the configuration.
+func (hc *HealthCheck) prepare() (err error) {
+	if hc.Path == "" {
+		hc.Path = DEFAULT_HEALTH_CHECK_PATH
+	}
+
+	if hc.Interval == 0 {
+		hc.Interval = DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+
+	if hc.Timeout == 0 {
+		hc.Timeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+
+	if hc.ExpectedStatus == "" {
+		hc.ExpectedStatus = DEFAULT_HEALTH_CHECK_EXPECTED_STATUS
+	}
+
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = DEFAULT_HEALTH_CHECK_HEALTHY_THRESHOLD
+	}
+
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = DEFAULT_HEALTH_CHECK_UNHEALTHY_THRESHOLD
+	}
+
+	if !strings.HasPrefix(hc.Path, "/") {
+		err = errors.Errorf(
+			"health check path %s must start with '/'", hc.Path)
+		return
+	}
+
+	if hc.Interval < 0 || hc.Timeout < 0 ||
+		hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+		err = errors.Errorf(
+			"health check interval, timeout and thresholds " +
+				"must be positive")
+		return
+	}
+
+	hc.minStatus, hc.maxStatus, err = ParseStatusRange(hc.ExpectedStatus)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid health check expected status")
+		return
+	}
+
+	return
+}
+
+// ParseStatusRange parses status ranges like `200-399`
+// or single statuses like `200`.
+func ParseStatusRange(str string) (min, max int, err error) {
+	var bounds = strings.SplitN(str, "-", 2)
+
+	min, err = strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		err = errors.Wrapf(err,
+			"status range %s is not numeric", str)
+		return
+	}
+
+	max = min
+	if len(bounds) == 2 {
+		max, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			err = errors.Wrapf(err,
+				"status range %s is not numeric", str)
+			return
+		}
+	}
+
+	if min < 100 || max > 599 || min > max {
+		err = errors.Errorf(
+			"status range %s must be within 100-599", str)
+		return
+	}
+
+	return
+}
+
+// probe performs a single health check against the server.
+func (u *upstream) probe(hc *HealthCheck) (ok bool) {
+	if u.tcp {
+		return u.probeTCP(hc)
+	}
+
+	if u.transport != nil {
+		return u.probeHTTP2(hc)
+	}
+
+	var (
+		req  = fasthttp.AcquireRequest()
+		resp = fasthttp.AcquireResponse()
+	)
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(u.scheme() + "://" + u.address + hc.Path)
+	err := u.client.DoTimeout(req, resp, hc.Timeout)
+	if err != nil {
+		return
+	}
+
+	ok = resp.StatusCode() >= hc.minStatus &&
+		resp.StatusCode() <= hc.maxStatus
+	return
+}
+
+// probeHTTP2 performs a single health check against a server
+// that only speaks HTTP/2.
+func (u *upstream) probeHTTP2(hc *HealthCheck) (ok bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		u.scheme()+"://"+u.address+hc.Path, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := u.transport.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	ok = resp.StatusCode >= hc.minStatus &&
+		resp.StatusCode <= hc.maxStatus
+	return
+}
+
+// runHealthCheck periodically probes the server updating
+// its health until `stop` gets closed.
+func (u *upstream) runHealthCheck(hc *HealthCheck, stop chan struct{}, logger zerolog.Logger) {
+	var (
+		successes int
+		failures  int
+		ticker    = time.NewTicker(hc.Interval)
+	)
+
+	defer ticker.Stop()
+
+	for {
+		ok := u.probe(hc)
+
+		u.Lock()
+		select {
+		case <-stop:
+			u.Unlock()
+			return
+		default:
+		}
+
+		if ok {
+			successes++
+			failures = 0
+		} else {
+			failures++
+			successes = 0
+		}
+
+		switch {
+		case successes >= hc.HealthyThreshold && !u.isHealthy():
+			atomic.StoreInt32(&u.healthy, 1)
+			logger.Info().
+				Msg("server healthy")
+		case failures >= hc.UnhealthyThreshold && u.isHealthy():
+			atomic.StoreInt32(&u.healthy, 0)
+			logger.Warn().
+				Msg("server unhealthy")
+		}
+		u.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
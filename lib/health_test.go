@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	var testCases = []struct {
+		input       string
+		min         int
+		max         int
+		shouldError bool
+	}{
+		{"200", 200, 200, false},
+		{"200-399", 200, 399, false},
+		{" 200 - 204 ", 200, 204, false},
+		{"", 0, 0, true},
+		{"abc", 0, 0, true},
+		{"200-abc", 200, 0, true},
+		{"399-200", 399, 200, true},
+		{"99", 99, 99, true},
+		{"200-600", 200, 600, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			min, max, err := ParseStatusRange(tc.input)
+			assert.Equal(t, tc.shouldError, err != nil)
+			if !tc.shouldError {
+				assert.Equal(t, tc.min, min)
+				assert.Equal(t, tc.max, max)
+			}
+		})
+	}
+}
+
+func TestHealthCheck_prepareFillsDefaults(t *testing.T) {
+	var hc = HealthCheck{}
+
+	assert.NoError(t, hc.prepare())
+	assert.Equal(t, DEFAULT_HEALTH_CHECK_PATH, hc.Path)
+	assert.Equal(t, DEFAULT_HEALTH_CHECK_INTERVAL, hc.Interval)
+	assert.Equal(t, DEFAULT_HEALTH_CHECK_TIMEOUT, hc.Timeout)
+	assert.Equal(t, 200, hc.minStatus)
+	assert.Equal(t, 399, hc.maxStatus)
+}
+
+func TestUpstream_healthCheckTransitions(t *testing.T) {
+	var status int32 = 200
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	address, err := NormalizeAddress(server.URL)
+	assert.NoError(t, err)
+
+	var (
+		u  = newUpstream(address, nil)
+		hc = &HealthCheck{
+			Interval:           10 * time.Millisecond,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		}
+	)
+
+	assert.NoError(t, hc.prepare())
+	u.setHealthCheck(hc, zerolog.Nop())
+	defer u.setHealthCheck(nil, zerolog.Nop())
+
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, u.isHealthy())
+	assert.Equal(t, "healthy", u.status())
+
+	atomic.StoreInt32(&status, 500)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, u.isHealthy())
+	assert.Equal(t, "unhealthy", u.status())
+
+	atomic.StoreInt32(&status, 204)
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, u.isHealthy())
+}
+
+func TestPool_skipsUnhealthyUpstreams(t *testing.T) {
+	var p = &pool{
+		balancer: &leastConnections{},
+		upstreams: []*upstream{
+			newUpstream("a:80", nil),
+			newUpstream("b:80", nil),
+			newUpstream("c:80", nil),
+		},
+	}
+
+	p.upstreams[1].healthy = 0
+	for i := 0; i < 10; i++ {
+		assert.NotEqual(t, "b:80", p.pick(nil).address,
+			fmt.Sprintf("iteration %d", i))
+	}
+
+	p.upstreams[0].healthy = 0
+	p.upstreams[2].healthy = 0
+	assert.Nil(t, p.pick(nil))
+}
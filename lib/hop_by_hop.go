@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"net/http"
+	"strings"
+)
+
+var (
+	// hopByHopHeaders only make sense for a single connection
+	// (RFC 7230, section 6.1) and so aren't forwarded.
+	hopByHopHeaders = map[string]bool{
+		"Connection":          true,
+		"Keep-Alive":          true,
+		"Proxy-Authenticate":  true,
+		"Proxy-Authorization": true,
+		"Proxy-Connection":    true,
+		"Te":                  true,
+		"Trailer":             true,
+		"Transfer-Encoding":   true,
+		"Upgrade":             true,
+	}
+
+	// upgradeHeaders must be kept when switching protocols.
+	upgradeHeaders = map[string]bool{
+		"Connection": true,
+		"Upgrade":    true,
+	}
+)
+
+// fasthttpHeader is implemented by the headers of both
+// fasthttp requests and responses.
+type fasthttpHeader interface {
+	VisitAll(f func(key, value []byte))
+	Del(key string)
+}
+
+// delHeaders removes the headers whose (canonical) names
+// match, whatever the case they were sent with.
+func delHeaders(h fasthttpHeader, match func(name string) bool) {
+	var keys []string
+
+	h.VisitAll(func(key, value []byte) {
+		if match(http.CanonicalHeaderKey(string(key))) {
+			keys = append(keys, string(key))
+		}
+	})
+
+	for _, key := range keys {
+		h.Del(key)
+	}
+}
+
+// peekHeader retrieves the values of the header `name` (in its
+// canonical form), whatever the case it was sent with, joined
+// with commas when sent multiple times.
+func peekHeader(h fasthttpHeader, name string) string {
+	var values []string
+
+	h.VisitAll(func(key, value []byte) {
+		if http.CanonicalHeaderKey(string(key)) == name {
+			values = append(values, string(value))
+		}
+	})
+
+	return strings.Join(values, ", ")
+}
+
+// stripHopByHop removes the hop-by-hop headers, as well as those
+// listed in the `Connection` header, except for those in `keep`.
+func stripHopByHop(h fasthttpHeader, keep map[string]bool) {
+	var listed = map[string]bool{}
+
+	h.VisitAll(func(key, value []byte) {
+		if http.CanonicalHeaderKey(string(key)) != "Connection" {
+			return
+		}
+
+		for _, token := range strings.Split(string(value), ",") {
+			listed[http.CanonicalHeaderKey(strings.TrimSpace(token))] = true
+		}
+	})
+
+	delHeaders(h, func(name string) bool {
+		return (hopByHopHeaders[name] || listed[name]) && !keep[name]
+	})
+}
@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestStripHopByHop(t *testing.T) {
+	var testCases = []struct {
+		desc     string
+		header   string
+		value    string
+		keep     map[string]bool
+		stripped bool
+	}{
+		{"connection", "Connection", "keep-alive", nil, true},
+		{"keep-alive", "Keep-Alive", "timeout=5", nil, true},
+		{"proxy-authenticate", "Proxy-Authenticate", "Basic", nil, true},
+		{"proxy-authorization", "Proxy-Authorization", "Basic dXNyOnB3ZA==", nil, true},
+		{"proxy-connection", "Proxy-Connection", "keep-alive", nil, true},
+		{"te", "TE", "trailers", nil, true},
+		{"trailer", "Trailer", "Expires", nil, true},
+		{"transfer-encoding", "Transfer-Encoding", "gzip", nil, true},
+		{"upgrade", "Upgrade", "websocket", nil, true},
+		{"any case", "keep-alive", "timeout=5", nil, true},
+		{"end-to-end", "X-Custom", "value", nil, false},
+		{"kept when upgrading", "Upgrade", "websocket", upgradeHeaders, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var (
+				request  fasthttp.RequestHeader
+				response fasthttp.ResponseHeader
+			)
+
+			request.DisableNormalizing()
+			request.Set(tc.header, tc.value)
+			stripHopByHop(&request, tc.keep)
+
+			response.DisableNormalizing()
+			response.Set(tc.header, tc.value)
+			stripHopByHop(&response, tc.keep)
+
+			if tc.stripped {
+				assert.Empty(t, request.Peek(tc.header))
+				assert.Empty(t, response.Peek(tc.header))
+			} else {
+				assert.Equal(t, tc.value, string(request.Peek(tc.header)))
+				assert.Equal(t, tc.value, string(response.Peek(tc.header)))
+			}
+		})
+	}
+}
+
+func TestStripHopByHop_removesHeadersListedInConnection(t *testing.T) {
+	var header fasthttp.RequestHeader
+
+	header.DisableNormalizing()
+	header.Set("Connection", "keep-alive, x-listed , X-Other")
+	header.Set("X-Listed", "1")
+	header.Set("x-other", "2")
+	header.Set("X-Kept", "3")
+
+	stripHopByHop(&header, nil)
+
+	assert.Empty(t, header.Peek("Connection"))
+	assert.Empty(t, header.Peek("X-Listed"))
+	assert.Empty(t, header.Peek("x-other"))
+	assert.Equal(t, "3", string(header.Peek("X-Kept")))
+}
+
+func TestL7_stripsHopByHopHeaders(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, values := range r.Header {
+			w.Header()["X-Echo-"+key] = values
+		}
+
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+	}))
+	defer server.Close()
+
+	lb, err := New(Config{
+		Users:              map[string]string{"user": "pwd"},
+		StripAuthorization: true,
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", lb.port))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Authorization: Basic %s\r\n"+
+		"Connection: keep-alive, X-Listed\r\n"+
+		"X-Listed: 1\r\n"+
+		"keep-alive: timeout=5\r\n"+
+		"Proxy-Authorization: Basic dXNyOnB3ZA==\r\n"+
+		"TE: trailers\r\n"+
+		"X-Custom: kept\r\n"+
+		"\r\n", mustBase64EncodeUser("user", "pwd"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	for _, name := range []string{"Authorization", "Connection", "X-Listed",
+		"Keep-Alive", "Proxy-Authorization", "Te"} {
+		assert.Empty(t, resp.Header.Get("X-Echo-"+name), name)
+	}
+	assert.Equal(t, "kept", resp.Header.Get("X-Echo-X-Custom"))
+
+	for _, name := range []string{"X-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+		assert.Empty(t, resp.Header.Get(name), name)
+	}
+}
+
+func TestL7_forwardsAuthorizationUnlessStripped(t *testing.T) {
+	var server = createHeadersServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		Users: map[string]string{"user": "pwd"},
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d", lb.port), nil)
+	assert.NoError(t, err)
+
+	req.Host = "example.com"
+	req.SetBasicAuth("user", "pwd")
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "Basic "+mustBase64EncodeUser("user", "pwd"),
+		resp.Header.Get("X-Echo-Authorization"))
+}
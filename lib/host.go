@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DEFAULT_BACKEND is the name of the backend that receives
+	// the requests whose host doesn't match any other backend.
+	DEFAULT_BACKEND = "*"
+
+	// WILDCARD_PREFIX prefixes the name of the backends that
+	// match any subdomain of the domain that follows it.
+	WILDCARD_PREFIX = "*."
+
+	// REGEX_PREFIX prefixes the name of the backends that
+	// match the hosts matching the regular expression that
+	// follows it.
+	REGEX_PREFIX = "~"
+)
+
+type hostRegex struct {
+	regex   *regexp.Regexp
+	backend *routeTable
+}
+
+// hostTable indexes the backends by the hosts they serve.
+//
+// Matching takes place in the following order:
+//  1. exact host names (e.g., `example.com`);
+//  2. wildcards (e.g., `*.example.com`), the most specific
+//     one winning;
+//  3. regular expressions (e.g., `~^api-[0-9]+\.example\.com$`),
+//     evaluated in the alphabetical order of their expressions;
+//  4. the default backend (`*`).
+//
+// Host names are matched case-insensitively.
+type hostTable struct {
+	exact     map[string]*routeTable
+	wildcards map[string]*routeTable
+	regexes   []hostRegex
+	fallback  *routeTable
+}
+
+func newHostTable() *hostTable {
+	return &hostTable{
+		exact:     make(map[string]*routeTable),
+		wildcards: make(map[string]*routeTable),
+	}
+}
+
+// add indexes the backend under the given name.
+//
+// Once all the backends have been added, `sort` must be called.
+func (ht *hostTable) add(name string, backend *routeTable) (err error) {
+	switch {
+	case name == DEFAULT_BACKEND:
+		ht.fallback = backend
+	case strings.HasPrefix(name, REGEX_PREFIX):
+		var regex *regexp.Regexp
+
+		regex, err = regexp.Compile(name[len(REGEX_PREFIX):])
+		if err != nil {
+			err = errors.Wrapf(err,
+				"invalid host regex %s", name)
+			return
+		}
+
+		ht.regexes = append(ht.regexes, hostRegex{
+			regex:   regex,
+			backend: backend,
+		})
+	case strings.HasPrefix(name, WILDCARD_PREFIX):
+		var suffix = strings.ToLower(name[len(WILDCARD_PREFIX)-1:])
+
+		if strings.Contains(suffix, "*") || len(suffix) == 1 {
+			err = errors.Errorf(
+				"invalid wildcard %s", name)
+			return
+		}
+
+		ht.wildcards[suffix] = backend
+	default:
+		if strings.Contains(name, "*") {
+			err = errors.Errorf(
+				"wildcards are only supported as the first "+
+					"label of a host (%s)", name)
+			return
+		}
+
+		ht.exact[strings.ToLower(name)] = backend
+	}
+
+	return
+}
+
+// sort makes the evaluation order of the regular
+// expressions deterministic.
+func (ht *hostTable) sort() {
+	sort.Slice(ht.regexes, func(i, j int) bool {
+		return ht.regexes[i].regex.String() < ht.regexes[j].regex.String()
+	})
+}
+
+// match retrieves the backend that should take care of
+// requests to the given host (without port).
+func (ht *hostTable) match(host []byte) (backend *routeTable, found bool) {
+	host = bytes.ToLower(host)
+
+	backend, found = ht.exact[string(host)]
+	if found {
+		return
+	}
+
+	if len(ht.wildcards) > 0 {
+		// a.b.example.com looks for .b.example.com,
+		// then .example.com and finally .com
+		for ndx := bytes.IndexByte(host, '.'); ndx != -1; {
+			backend, found = ht.wildcards[string(host[ndx:])]
+			if found {
+				return
+			}
+
+			next := bytes.IndexByte(host[ndx+1:], '.')
+			if next == -1 {
+				break
+			}
+			ndx += next + 1
+		}
+	}
+
+	for _, hr := range ht.regexes {
+		if hr.regex.Match(host) {
+			backend, found = hr.backend, true
+			return
+		}
+	}
+
+	backend = ht.fallback
+	found = backend != nil
+	return
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostTable_match(t *testing.T) {
+	var names = []string{
+		"example.com",
+		"*.example.com",
+		"*.api.example.com",
+		"~^tenant-[0-9]+\\.",
+		"~^tenant-",
+		"~\\.internal$",
+		"*",
+	}
+
+	var testCases = []struct {
+		host    string
+		backend string
+	}{
+		{"example.com", "example.com"},
+		{"EXAMPLE.com", "example.com"},
+		{"www.example.com", "*.example.com"},
+		{"a.b.example.com", "*.example.com"},
+		{"v1.api.example.com", "*.api.example.com"},
+		{"api.example.com", "*.example.com"},
+		{"tenant-1.something.io", "~^tenant-"},
+		{"tenant-a.something.io", "~^tenant-"},
+		{"db.internal", "~\\.internal$"},
+		{"tenant-1.example.com", "*.example.com"},
+		{"something.io", "*"},
+		{"localhost", "*"},
+	}
+
+	var ht = newHostTable()
+	for _, name := range names {
+		assert.NoError(t, ht.add(name, &routeTable{name: name}))
+	}
+	ht.sort()
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			rt, found := ht.match([]byte(tc.host))
+			assert.True(t, found)
+			assert.Equal(t, tc.backend, rt.name)
+		})
+	}
+}
+
+func TestHostTable_matchWithoutDefault(t *testing.T) {
+	var ht = newHostTable()
+	assert.NoError(t, ht.add("*.example.com", &routeTable{}))
+	ht.sort()
+
+	for _, host := range []string{"example.com", "com", "", "example.com.br"} {
+		_, found := ht.match([]byte(host))
+		assert.False(t, found, host)
+	}
+}
+
+func TestHostTable_addFailsOnInvalidNames(t *testing.T) {
+	for _, name := range []string{
+		"*.",
+		"www.*.com",
+		"**.example.com",
+		"~^(tenant",
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, newHostTable().add(name, &routeTable{}))
+		})
+	}
+}
@@ -0,0 +1,421 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DEFAULT_HTTP2_MAX_CONCURRENT_STREAMS = 250
+	DEFAULT_HTTP2_CONNECTION_WINDOW      = 1 << 20
+	DEFAULT_HTTP2_STREAM_WINDOW          = 1 << 20
+
+	// handshakeTimeout bounds the time taken to figure out
+	// which protocol a new connection speaks.
+	handshakeTimeout = 10 * time.Second
+
+	http2MinWindow = 64 << 10
+	http2MaxWindow = 4 << 20
+
+	http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	// h2StreamKey is the key under which the stream of requests
+	// received over HTTP/2 is kept within their context.
+	h2StreamKey = "h2stream"
+)
+
+var (
+	errListenerClosed = errors.Errorf("listener closed")
+)
+
+// HTTP2 enables HTTP/2 on the listeners: negotiated via ALPN
+// over TLS and, if `H2C` is set, spoken in cleartext by the
+// clients that know in advance that it's supported (prior
+// knowledge).
+//
+// Requests are routed and forwarded to the servers (over
+// HTTP/1.1) as any other.
+type HTTP2 struct {
+	H2C                  bool `yaml:"h2c"`
+	MaxConcurrentStreams int  `yaml:"max_concurrent_streams"`
+	ConnectionWindow     int  `yaml:"connection_window"`
+	StreamWindow         int  `yaml:"stream_window"`
+}
+
+// prepare fills the fields not specified with their
+// defaults and validates the configuration.
+func (h *HTTP2) prepare() (err error) {
+	if h.MaxConcurrentStreams == 0 {
+		h.MaxConcurrentStreams = DEFAULT_HTTP2_MAX_CONCURRENT_STREAMS
+	}
+
+	if h.ConnectionWindow == 0 {
+		h.ConnectionWindow = DEFAULT_HTTP2_CONNECTION_WINDOW
+	}
+
+	if h.StreamWindow == 0 {
+		h.StreamWindow = DEFAULT_HTTP2_STREAM_WINDOW
+	}
+
+	if h.MaxConcurrentStreams < 0 {
+		err = errors.Errorf(
+			"http2 max_concurrent_streams must be positive")
+		return
+	}
+
+	if h.ConnectionWindow < http2MinWindow || h.ConnectionWindow > http2MaxWindow ||
+		h.StreamWindow < http2MinWindow || h.StreamWindow > http2MaxWindow {
+		err = errors.Errorf(
+			"http2 flow-control windows must be within 64KiB and 4MiB")
+		return
+	}
+
+	return
+}
+
+// chanListener hands over the connections pushed to it.
+type chanListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	err   error
+}
+
+func newChanListener(addr net.Addr) *chanListener {
+	return &chanListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *chanListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *chanListener) Accept() (conn net.Conn, err error) {
+	select {
+	case conn = <-l.conns:
+	case <-l.done:
+		err = l.err
+	}
+
+	return
+}
+
+func (l *chanListener) closeWith(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *chanListener) Close() error {
+	l.closeWith(errListenerClosed)
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.addr
+}
+
+// protocolClassifier tells whether a connection speaks HTTP/2,
+// returning the connection to be served from then on.
+type protocolClassifier func(c net.Conn) (conn net.Conn, h2 bool, err error)
+
+// dispatchingListener splits the connections accepted by a
+// listener between an HTTP/1 and an HTTP/2 listener.
+type dispatchingListener struct {
+	ln       net.Listener
+	classify protocolClassifier
+	http1    *chanListener
+	http2    *chanListener
+}
+
+func newDispatchingListener(ln net.Listener, classify protocolClassifier) *dispatchingListener {
+	return &dispatchingListener{
+		ln:       ln,
+		classify: classify,
+		http1:    newChanListener(ln.Addr()),
+		http2:    newChanListener(ln.Addr()),
+	}
+}
+
+func (d *dispatchingListener) serve() {
+	for {
+		c, err := d.ln.Accept()
+		if err != nil {
+			d.http1.closeWith(err)
+			d.http2.closeWith(err)
+			return
+		}
+
+		go func() {
+			conn, h2, err := d.classify(c)
+			if err != nil {
+				c.Close()
+				return
+			}
+
+			if h2 {
+				d.http2.push(conn)
+			} else {
+				d.http1.push(conn)
+			}
+		}()
+	}
+}
+
+// setLongLived makes the tracked connection underlying `c`
+// never be considered idle.
+func setLongLived(c net.Conn) {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+
+	if peeked, ok := c.(*peekedConn); ok {
+		c = peeked.Conn
+	}
+
+	if tracked, ok := c.(*trackedConn); ok {
+		tracked.setLongLived()
+	}
+}
+
+// negotiateProtocol completes the TLS handshake, picking
+// the protocol agreed via ALPN.
+func negotiateProtocol(c net.Conn) (conn net.Conn, h2 bool, err error) {
+	var tlsConn = c.(*tls.Conn)
+
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	h2 = tlsConn.ConnectionState().NegotiatedProtocol == "h2"
+	if h2 {
+		setLongLived(c)
+	}
+
+	conn = c
+	return
+}
+
+// peekedConn replays what was peeked from a connection.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// detectPriorKnowledge checks whether the connection starts
+// with the HTTP/2 preface.
+func detectPriorKnowledge(c net.Conn) (conn net.Conn, h2 bool, err error) {
+	var br = bufio.NewReader(c)
+
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	h2, err = peekPrefix(br, http2Preface)
+	if err != nil {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	if h2 {
+		setLongLived(c)
+	}
+
+	conn = &peekedConn{Conn: c, r: br}
+	return
+}
+
+// fasthttpLogger makes fasthttp log through zerolog.
+type fasthttpLogger struct {
+	logger zerolog.Logger
+}
+
+func (l fasthttpLogger) Printf(format string, args ...interface{}) {
+	l.logger.Warn().Msgf(format, args...)
+}
+
+// streamConn stands for the connection of an HTTP/2 stream
+// within fasthttp.
+type streamConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// tlsStreamConn stands for the connection of an HTTP/2 stream
+// received over TLS, exposing the state of the connection.
+type tlsStreamConn struct {
+	streamConn
+	state tls.ConnectionState
+}
+
+func (c *tlsStreamConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+// h2Stream is an HTTP/2 request (and its response) which can be
+// answered directly instead of through fasthttp, e.g., when
+// forwarding it as a stream.
+type h2Stream struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	bodyRead bool
+	answered bool
+}
+
+// streamsBody tells whether the request is routed to servers
+// that have its body streamed rather than buffered.
+func (lb *L7) streamsBody(r *http.Request) bool {
+	lb.RLock()
+	rt, _ := lb.backends.match(hostWithoutPort([]byte(r.Host)))
+	lb.RUnlock()
+
+	if rt == nil {
+		return false
+	}
+
+	route, found := rt.match([]byte(r.URL.Path))
+	return found && route.pool != nil && route.pool.protocol == PROTOCOL_GRPC
+}
+
+// serveHTTP2 handles an HTTP/2 request as any other by
+// translating it to (and its response from) fasthttp.
+//
+// gRPC requests failed by `l7` itself are answered with
+// the equivalent gRPC status.
+func (lb *L7) serveHTTP2(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx    fasthttp.RequestCtx
+		conn   net.Conn
+		sc     = streamConn{local: &net.TCPAddr{}, remote: &net.TCPAddr{}}
+		stream = &h2Stream{w: w, r: r}
+	)
+
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		sc.remote = addr
+	}
+
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		sc.local = addr
+	}
+
+	conn = &sc
+	if r.TLS != nil {
+		conn = &tlsStreamConn{streamConn: sc, state: *r.TLS}
+	}
+
+	ctx.Init2(conn, fasthttpLogger{lb.logger}, false)
+	ctx.SetUserValue(h2StreamKey, stream)
+
+	if !lb.streamsBody(r) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+		if err != nil {
+			if _, ok := err.(*http.MaxBytesError); ok {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			return
+		}
+
+		ctx.Request.SetBody(body)
+		stream.bodyRead = true
+	}
+
+	ctx.Request.Header.SetMethod(r.Method)
+	ctx.Request.SetRequestURI(r.URL.RequestURI())
+	ctx.Request.Header.SetHost(r.Host)
+	for key, values := range r.Header {
+		for _, value := range values {
+			ctx.Request.Header.Add(key, value)
+		}
+	}
+
+	lb.handler(&ctx)
+
+	if stream.answered {
+		return
+	}
+
+	status := ctx.Response.StatusCode()
+	if isGRPC(r.Header.Get("Content-Type")) && status != http.StatusOK {
+		w.Header().Set(lb.requestID.Header, requestIDOf(&ctx))
+		writeGRPCError(w, status)
+		return
+	}
+
+	ctx.Response.Header.VisitAll(func(key, value []byte) {
+		name := http.CanonicalHeaderKey(string(key))
+		if !hopByHopHeaders[name] {
+			w.Header().Add(name, string(value))
+		}
+	})
+
+	w.WriteHeader(status)
+	w.Write(ctx.Response.Body())
+}
+
+// serve serves the connections accepted by the listener,
+// handing those classified as HTTP/2 to the HTTP/2 server.
+func (lb *L7) serve(server *fasthttp.Server, ln net.Listener, classify protocolClassifier, errs chan<- error) {
+	if lb.h2Server == nil || classify == nil {
+		errs <- server.Serve(ln)
+		return
+	}
+
+	d := newDispatchingListener(ln, classify)
+	go d.serve()
+	go func() {
+		errs <- lb.h2Server.Serve(d.http2)
+	}()
+
+	errs <- server.Serve(d.http1)
+}
+
+// newHTTP2Server creates the server that handles the
+// HTTP/2 connections.
+func (lb *L7) newHTTP2Server(h *HTTP2) *http.Server {
+	var server = &http.Server{
+		Handler: http.HandlerFunc(lb.serveHTTP2),
+		HTTP2: &http.HTTP2Config{
+			MaxConcurrentStreams:          h.MaxConcurrentStreams,
+			MaxReceiveBufferPerConnection: h.ConnectionWindow,
+			MaxReceiveBufferPerStream:     h.StreamWindow,
+		},
+		Protocols: new(http.Protocols),
+	}
+
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(h.H2C)
+	return server
+}
@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createMirrorServer creates a server that responds with
+// the host, a header and the body of the requests.
+func createMirrorServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Mirror", r.Header.Get("X-Mirror"))
+		fmt.Fprintf(w, "%s ", r.Host)
+		io.Copy(w, r.Body)
+	}))
+}
+
+func http2Client(protocols func(p *http.Protocols)) *http.Client {
+	var transport = &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		Protocols:       new(http.Protocols),
+	}
+
+	protocols(transport.Protocols)
+	return &http.Client{Transport: transport}
+}
+
+func mirror(client *http.Client, url, host, body string) (resp *http.Response, data string, err error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	req.Host = host
+	req.Header.Set("X-Mirror", "mirrored")
+
+	resp, err = client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	data = string(raw)
+	return
+}
+
+func TestHTTP2_prepare(t *testing.T) {
+	var testCases = []struct {
+		desc        string
+		http2       HTTP2
+		shouldError bool
+	}{
+		{"defaults", HTTP2{}, false},
+		{"custom", HTTP2{MaxConcurrentStreams: 10, ConnectionWindow: 1 << 16, StreamWindow: 1 << 16}, false},
+		{"negative streams", HTTP2{MaxConcurrentStreams: -1}, true},
+		{"small connection window", HTTP2{ConnectionWindow: 1024}, true},
+		{"largest windows", HTTP2{ConnectionWindow: 4 << 20, StreamWindow: 4 << 20}, false},
+		{"large connection window", HTTP2{ConnectionWindow: 4<<20 + 1}, true},
+		{"large stream window", HTTP2{StreamWindow: 8 << 20}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := tc.http2.prepare()
+			if tc.shouldError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.True(t, tc.http2.MaxConcurrentStreams > 0)
+			assert.True(t, tc.http2.ConnectionWindow > 0)
+			assert.True(t, tc.http2.StreamWindow > 0)
+		})
+	}
+}
+
+func TestL7_servesHTTP2OverTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l7-http2")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var server = createMirrorServer()
+	defer server.Close()
+
+	cert, key := createCertificate(t, dir, "default")
+
+	lb, err := New(Config{
+		TLS:   &TLS{Cert: cert, Key: key},
+		HTTP2: &HTTP2{},
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	lb.tlsPort = 0
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var (
+		url = fmt.Sprintf("https://localhost:%d/", lb.tlsPort)
+		h2  = http2Client(func(p *http.Protocols) { p.SetHTTP2(true) })
+		h1  = http2Client(func(p *http.Protocols) { p.SetHTTP1(true) })
+	)
+
+	resp, data, err := mirror(h2, url, "example.com", "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "mirrored", resp.Header.Get("X-Mirror"))
+	assert.Equal(t, "example.com hello", data)
+
+	resp, _, err = mirror(h2, url, "unknown.com", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// clients not speaking HTTP/2 are still served
+	resp, data, err = mirror(h1, url, "example.com", "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Equal(t, "example.com hello", data)
+}
+
+func TestL7_servesH2CWithPriorKnowledge(t *testing.T) {
+	var server = createMirrorServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		HTTP2: &HTTP2{H2C: true},
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var (
+		url = fmt.Sprintf("http://localhost:%d/", lb.port)
+		h2c = http2Client(func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) })
+	)
+
+	resp, data, err := mirror(h2c, url, "example.com", "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "example.com hello", data)
+
+	resp, err = targetHost("example.com", lb.port)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestL7_limitsHTTP2RequestBodies(t *testing.T) {
+	var server = createMirrorServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		HTTP2: &HTTP2{H2C: true},
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var (
+		url = fmt.Sprintf("http://localhost:%d/", lb.port)
+		h2c = http2Client(func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) })
+	)
+
+	resp, _, err := mirror(h2c, url, "example.com", strings.Repeat("a", maxRequestBodySize))
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, _, err = mirror(h2c, url, "example.com", strings.Repeat("a", maxRequestBodySize+1))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestL7_drainsHTTP2Connections(t *testing.T) {
+	var server = createMirrorServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		DrainTimeout: 2 * time.Second,
+		HTTP2:        &HTTP2{H2C: true},
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	listened := make(chan error, 1)
+	go func() {
+		listened <- lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var h2c = http2Client(func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) })
+
+	_, _, err = mirror(h2c, fmt.Sprintf("http://localhost:%d/", lb.port), "example.com", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, lb.conns.count())
+
+	start := time.Now()
+	assert.NoError(t, lb.Shutdown())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.NoError(t, <-listened)
+	assert.Equal(t, 0, lb.conns.count())
+}
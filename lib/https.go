@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DEFAULT_HSTS_MAX_AGE = 365 * 24 * time.Hour
+
+	// hstsPreloadMinMaxAge is the minimum max-age accepted
+	// by the browsers' preload lists.
+	hstsPreloadMinMaxAge = 365 * 24 * time.Hour
+)
+
+var (
+	locationHeader = []byte("Location")
+	hstsHeader     = []byte("Strict-Transport-Security")
+)
+
+// HSTS configures the `Strict-Transport-Security` header added
+// to the responses sent over HTTPS, instructing browsers to
+// only reach the backend over HTTPS from then on.
+type HSTS struct {
+	MaxAge            time.Duration `yaml:"max_age"`
+	IncludeSubDomains bool          `yaml:"include_subdomains"`
+	Preload           bool          `yaml:"preload"`
+
+	header []byte
+}
+
+// prepare fills the fields not specified with their
+// defaults and validates the configuration.
+func (h *HSTS) prepare() (err error) {
+	if h.MaxAge == 0 {
+		h.MaxAge = DEFAULT_HSTS_MAX_AGE
+	}
+
+	if h.MaxAge < 0 {
+		err = errors.Errorf(
+			"hsts max_age must be positive")
+		return
+	}
+
+	if h.Preload && (!h.IncludeSubDomains || h.MaxAge < hstsPreloadMinMaxAge) {
+		err = errors.Errorf(
+			"hsts preload requires include_subdomains and " +
+				"a max_age of at least one year")
+		return
+	}
+
+	header := "max-age=" + strconv.Itoa(int(h.MaxAge.Seconds()))
+	if h.IncludeSubDomains {
+		header += "; includeSubDomains"
+	}
+	if h.Preload {
+		header += "; preload"
+	}
+
+	h.header = []byte(header)
+	return
+}
+
+// hostWithoutPort strips the port (if any) from a Host header.
+func hostWithoutPort(host []byte) []byte {
+	for ndx := len(host) - 1; ndx >= 0; ndx-- {
+		switch host[ndx] {
+		case ':':
+			return host[:ndx]
+		case ']':
+			return host
+		}
+	}
+
+	return host
+}
+
+// redirectToHTTPS redirects the plaintext requests made to the
+// backends that force HTTPS to their HTTPS equivalent (same host,
+// path and query), telling whether the request got redirected.
+//
+// GET and HEAD requests get a 301 while the rest get a 308 so
+// that their method and body are kept.
+func (lb *L7) redirectToHTTPS(ctx *fasthttp.RequestCtx, rt *routeTable) (redirected bool) {
+	if ctx.IsTLS() || rt == nil || !rt.forceHTTPS {
+		return
+	}
+
+	lb.RLock()
+	withTLS, tlsPort := lb.tlsConfig != nil, lb.tlsPort
+	lb.RUnlock()
+
+	location := "https://" + string(hostWithoutPort(ctx.Host()))
+	if withTLS && tlsPort != DEFAULT_TLS_PORT {
+		location += ":" + strconv.Itoa(tlsPort)
+	}
+	location += string(ctx.RequestURI())
+
+	status := fasthttp.StatusPermanentRedirect
+	if ctx.IsGet() || ctx.IsHead() {
+		status = fasthttp.StatusMovedPermanently
+	}
+
+	lb.logger.Debug().
+		Uint64("id", ctx.ConnID()).
+		Str("request_id", requestIDOf(ctx)).
+		Str("location", location).
+		Msg("redirecting to https")
+
+	ctx.Response.Header.SetBytesK(locationHeader, location)
+	ctx.SetStatusCode(status)
+	redirected = true
+	return
+}
+
+// addHSTS adds the HSTS header of the backend `rt` (if any)
+// to the responses sent over HTTPS.
+func (rt *routeTable) addHSTS(ctx *fasthttp.RequestCtx) {
+	if rt.hsts != nil && ctx.IsTLS() {
+		ctx.Response.Header.SetBytesKV(hstsHeader, rt.hsts.header)
+	}
+}
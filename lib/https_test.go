@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostWithoutPort(t *testing.T) {
+	var testCases = map[string]string{
+		"example.com":      "example.com",
+		"example.com:8080": "example.com",
+		"127.0.0.1:80":     "127.0.0.1",
+		"[::1]":            "[::1]",
+		"[::1]:443":        "[::1]",
+		"":                 "",
+	}
+
+	for input, expected := range testCases {
+		assert.Equal(t, expected, string(hostWithoutPort([]byte(input))), input)
+	}
+}
+
+func TestHSTS_prepare(t *testing.T) {
+	var testCases = []struct {
+		hsts        HSTS
+		header      string
+		shouldError bool
+	}{
+		{HSTS{}, "max-age=31536000", false},
+		{HSTS{MaxAge: time.Hour, IncludeSubDomains: true}, "max-age=3600; includeSubDomains", false},
+		{HSTS{IncludeSubDomains: true, Preload: true}, "max-age=31536000; includeSubDomains; preload", false},
+		{HSTS{Preload: true}, "", true},
+		{HSTS{MaxAge: time.Hour, IncludeSubDomains: true, Preload: true}, "", true},
+		{HSTS{MaxAge: -time.Hour}, "", true},
+	}
+
+	for _, tc := range testCases {
+		err := tc.hsts.prepare()
+		if tc.shouldError {
+			assert.Error(t, err)
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.Equal(t, tc.header, string(tc.hsts.header))
+	}
+}
+
+func TestL7_forcesHTTPS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l7-https")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var server = createServer("secure")
+	defer server.Close()
+
+	cert, key := createCertificate(t, dir, "default")
+
+	lb, err := New(Config{
+		TLS:   &TLS{Cert: cert, Key: key},
+		Users: map[string]string{"user": "pass"},
+		Backends: map[string]Backend{
+			"secure.com": Backend{
+				Servers:    []Server{{Address: server.URL}},
+				ForceHTTPS: true,
+				HSTS:       &HSTS{MaxAge: time.Hour},
+			},
+			"plain.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	lb.tlsPort = 0
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	var testCases = []struct {
+		method   string
+		url      string
+		host     string
+		status   int
+		location string
+		hsts     string
+	}{
+		{
+			"GET", fmt.Sprintf("http://localhost:%d/a/b?c=d", lb.port), "secure.com",
+			301, fmt.Sprintf("https://secure.com:%d/a/b?c=d", lb.tlsPort), "",
+		},
+		{
+			"POST", fmt.Sprintf("http://localhost:%d/form", lb.port), "secure.com:8080",
+			308, fmt.Sprintf("https://secure.com:%d/form", lb.tlsPort), "",
+		},
+		{
+			"GET", fmt.Sprintf("https://localhost:%d/", lb.tlsPort), "secure.com",
+			200, "", "max-age=3600",
+		},
+		{
+			"GET", fmt.Sprintf("http://localhost:%d/", lb.port), "plain.com",
+			200, "", "",
+		},
+		{
+			"GET", fmt.Sprintf("https://localhost:%d/", lb.tlsPort), "plain.com",
+			200, "", "",
+		},
+	}
+
+	for _, tc := range testCases {
+		req, err := http.NewRequest(tc.method, tc.url, strings.NewReader(""))
+		assert.NoError(t, err)
+
+		req.Host = tc.host
+		req.SetBasicAuth("user", "pass")
+
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, tc.status, resp.StatusCode, tc.url)
+		assert.Equal(t, tc.location, resp.Header.Get("Location"), tc.url)
+		assert.Equal(t, tc.hsts, resp.Header.Get("Strict-Transport-Security"), tc.url)
+	}
+
+	// credentials aren't required before redirecting
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/", lb.port), nil)
+	assert.NoError(t, err)
+	req.Host = "secure.com"
+
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 301, resp.StatusCode)
+}
@@ -2,11 +2,14 @@ package lib
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -18,19 +21,49 @@ var (
 	ErrInvalidAddress = errors.Errorf("Supplied address is invalid")
 )
 
+const (
+	// maxRequestBodySize bounds the size of the request
+	// bodies buffered, whatever the protocol they're sent
+	// over.
+	maxRequestBodySize = fasthttp.DefaultMaxRequestBodySize
+)
+
 type L7 struct {
 	sync.RWMutex
 
 	logger         zerolog.Logger
 	publicBackends map[string]Backend
 	users          [][]byte
+	stripAuth      bool
 	port           int
 	listener       net.Listener
-	backends       map[string]*fasthttp.LBClient
+	tlsPort        int
+	tlsListener    net.Listener
+	tlsConfig      *tls.Config
+	certificate    *tls.Certificate
+	clientAuth     *ClientAuth
+	http2          *HTTP2
+	proxyProtocol  *ProxyProtocol
+	requestID      *RequestID
+	forwarded      *ForwardedHeaders
+	h2Server       *http.Server
+	backends       *hostTable
+	upstreams      map[string]*upstream
+	tcpProxies     map[string]*tcpProxy
+	tcpUpstreams   map[string]*upstream
+	tcpListeners   []*tcpListener
+	conns          *connTracker
+	drainTimeout   time.Duration
 }
 
 func New(cfg Config) (lb L7, err error) {
 	lb.port = cfg.Port
+	lb.conns = newConnTracker()
+
+	lb.drainTimeout = cfg.DrainTimeout
+	if lb.drainTimeout == 0 {
+		lb.drainTimeout = DEFAULT_DRAIN_TIMEOUT
+	}
 
 	if cfg.Debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
@@ -43,6 +76,69 @@ func New(cfg Config) (lb L7, err error) {
 	if len(cfg.Users) > 0 {
 		lb.LoadUsers(cfg.Users)
 	}
+	lb.stripAuth = cfg.StripAuthorization
+
+	if cfg.ProxyProtocol != nil {
+		lb.proxyProtocol = new(ProxyProtocol)
+		*lb.proxyProtocol = *cfg.ProxyProtocol
+
+		err = lb.proxyProtocol.prepare()
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Couldn't load proxy protocol configuration")
+			return
+		}
+	}
+
+	lb.requestID = new(RequestID)
+	if cfg.RequestID != nil {
+		*lb.requestID = *cfg.RequestID
+	}
+
+	err = lb.requestID.prepare()
+	if err != nil {
+		err = errors.Wrapf(err,
+			"Couldn't load request id configuration")
+		return
+	}
+
+	if cfg.ForwardedHeaders != nil {
+		lb.forwarded = new(ForwardedHeaders)
+		*lb.forwarded = *cfg.ForwardedHeaders
+
+		err = lb.forwarded.prepare()
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Couldn't load forwarded headers configuration")
+			return
+		}
+	}
+
+	if cfg.HTTP2 != nil {
+		lb.http2 = new(HTTP2)
+		*lb.http2 = *cfg.HTTP2
+
+		err = lb.http2.prepare()
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Couldn't load http2 configuration")
+			return
+		}
+	}
+
+	if cfg.TLS != nil {
+		lb.tlsPort = cfg.TLS.Port
+		if lb.tlsPort == 0 {
+			lb.tlsPort = DEFAULT_TLS_PORT
+		}
+
+		err = lb.LoadTLS(cfg.TLS)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Couldn't load tls configuration")
+			return
+		}
+	}
 
 	err = lb.LoadBackends(cfg.Backends)
 	if err != nil {
@@ -51,6 +147,49 @@ func New(cfg Config) (lb L7, err error) {
 		return
 	}
 
+	err = lb.LoadTCP(cfg.TCP)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"Couldn't load tcp listeners")
+		return
+	}
+
+	return
+}
+
+// Reload replaces the backends, the TCP listeners and the TLS
+// configuration with those of `cfg` at once: if any of them is
+// invalid, nothing changes.
+func (lb *L7) Reload(cfg Config) (err error) {
+	backends, err := lb.compileBackends(cfg.Backends)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"Couldn't load backends")
+		return
+	}
+
+	tcp, err := lb.compileTCP(cfg.TCP)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"Couldn't load tcp listeners")
+		return
+	}
+
+	tlsConfig, err := lb.compileTLS(cfg.TLS)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"Couldn't load tls configuration")
+		return
+	}
+
+	lb.Lock()
+	lb.setBackends(backends)
+	lb.setTCP(tcp)
+	lb.setTLS(tlsConfig)
+	lb.Unlock()
+
+	lb.startHealthChecks(backends)
+	lb.startTCPHealthChecks(tcp)
 	return
 }
 
@@ -75,63 +214,373 @@ func (lb *L7) LoadUsers(users map[string]string) {
 	}
 }
 
+// compiledBackends are the backends of a configuration,
+// validated and ready to replace the current ones.
+type compiledBackends struct {
+	public       map[string]Backend
+	hosts        *hostTable
+	upstreams    map[string]*upstream
+	previous     map[string]*upstream
+	healthChecks map[*upstream]*HealthCheck
+}
+
+// LoadBackends (re)loads the backends, leaving the current
+// ones untouched if the configuration is invalid.
 func (lb *L7) LoadBackends(backends map[string]Backend) (err error) {
+	compiled, err := lb.compileBackends(backends)
+	if err != nil {
+		return
+	}
+
+	lb.Lock()
+	lb.setBackends(compiled)
+	lb.Unlock()
+
+	lb.startHealthChecks(compiled)
+	return
+}
+
+// setBackends replaces the current backends, the write lock
+// being held by the caller.
+func (lb *L7) setBackends(compiled *compiledBackends) {
+	lb.publicBackends = compiled.public
+	lb.backends = compiled.hosts
+	lb.upstreams = compiled.upstreams
+}
+
+// startHealthChecks (re)configures the health checks of the
+// upstreams once the backends got replaced, stopping those of
+// the upstreams that aren't used anymore.
+func (lb *L7) startHealthChecks(compiled *compiledBackends) {
+	for u, hc := range compiled.healthChecks {
+		u.setHealthCheck(hc, lb.logger)
+	}
+
+	for key, u := range compiled.previous {
+		if compiled.upstreams[key] != u {
+			u.setHealthCheck(nil, lb.logger)
+		}
+	}
+}
+
+// compileBackends validates the backends and creates what
+// they're made of, reusing the current upstreams.
+func (lb *L7) compileBackends(backends map[string]Backend) (compiled *compiledBackends, err error) {
 	var (
-		lbc  *fasthttp.LBClient
+		rt   *routeTable
 		be   Backend
-		url  string
 		name string
+		hc   *HealthCheck
+		od   *OutlierDetection
+		st   *Sticky
+		ut   *UpstreamTLS
+
+		hashKey hashKeyFunc
 
-		internalBackends = make(map[string]*fasthttp.LBClient)
+		internalBackends = newHostTable()
+		upstreams        = make(map[string]*upstream)
+		healthChecks     = make(map[*upstream]*HealthCheck)
 	)
 
 	lb.logger.Debug().
 		Int("total", len(backends)).
 		Msg("loading backends")
 
-	for name, be = range backends {
-		if len(be.Servers) == 0 {
-			lb.logger.Debug().Str("backend", name).Msg("no servers")
-			internalBackends[name] = nil
-			continue
-		}
+	lb.RLock()
+	previousUpstreams := lb.upstreams
+	lb.RUnlock()
 
+	for name, be = range backends {
 		lb.logger.Debug().
 			Str("backend", name).
 			Int("total", len(be.Servers)).
+			Int("routes", len(be.Routes)).
 			Msg("loading servers")
 
-		lbc = &fasthttp.LBClient{}
-		for _, server := range be.Servers {
-			url, err = NormalizeAddress(server.Address)
+		hc = nil
+		if be.HealthCheck != nil {
+			hc = new(HealthCheck)
+			*hc = *be.HealthCheck
+			err = hc.prepare()
 			if err != nil {
 				err = errors.Wrapf(err,
-					"Can't use address %s as a server address",
-					server.Address)
+					"Can't load backend %s", name)
 				return
 			}
+		}
 
-			lb.logger.Debug().
-				Str("backend", name).
-				Str("server", url).
-				Msg("server loaded")
+		od = nil
+		if be.OutlierDetection != nil {
+			od = new(OutlierDetection)
+			*od = *be.OutlierDetection
+			err = od.prepare()
+			if err != nil {
+				err = errors.Wrapf(err,
+					"Can't load backend %s", name)
+				return
+			}
+		}
 
-			lbc.Clients = append(lbc.Clients, &fasthttp.HostClient{
-				Addr: url,
-			})
+		st = nil
+		if be.Sticky != nil {
+			st = new(Sticky)
+			*st = *be.Sticky
+			err = st.prepare()
+			if err != nil {
+				err = errors.Wrapf(err,
+					"Can't load backend %s", name)
+				return
+			}
+		}
+
+		ut = new(UpstreamTLS)
+		if be.UpstreamTLS != nil {
+			*ut = *be.UpstreamTLS
+		}
+		err = ut.prepare()
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Can't load backend %s", name)
+			return
+		}
+
+		hashKey = nil
+		if be.Algorithm == ALGORITHM_CONSISTENT_HASH {
+			hashKey, err = newHashKeyFunc(be.HashOn)
+			if err != nil {
+				err = errors.Wrapf(err,
+					"Can't load backend %s", name)
+				return
+			}
+		} else if be.HashOn != "" {
+			err = errors.Errorf(
+				"Can't load backend %s: hash_on requires the %s algorithm",
+				name, ALGORITHM_CONSISTENT_HASH)
+			return
+		}
+
+		protocol := be.Protocol
+		if protocol == "" {
+			protocol = DEFAULT_PROTOCOL
+		}
+		err = validateProtocol(protocol)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Can't load backend %s", name)
+			return
+		}
+
+		err = validateProxyProtocolVersion(be.SendProxyProtocol)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Can't load backend %s", name)
+			return
+		}
+
+		if protocol == PROTOCOL_GRPC && be.SendProxyProtocol != "" {
+			err = errors.Errorf(
+				"Can't load backend %s: send_proxy_protocol can't be "+
+					"used with the %s protocol", name, PROTOCOL_GRPC)
+			return
+		}
+
+		tunnelIdle := be.TunnelIdleTimeout
+		if tunnelIdle == 0 {
+			tunnelIdle = DEFAULT_TUNNEL_IDLE_TIMEOUT
+		} else if tunnelIdle < 0 {
+			err = errors.Errorf(
+				"Can't load backend %s: tunnel_idle_timeout must be positive",
+				name)
+			return
+		}
+
+		rt, err = newRouteTable(be, func(servers []Server) (p *pool, err error) {
+			p, err = lb.newPool(name, be.Algorithm, protocol, servers, ut,
+				previousUpstreams, upstreams)
+			if p != nil {
+				p.hashKey = hashKey
+				if st != nil {
+					p.setSticky(st)
+				}
+				p.outlierDetection = od
+				p.tunnelIdle = tunnelIdle
+				p.protocol = protocol
+				p.sendProxy = be.SendProxyProtocol
+				for _, u := range p.upstreams {
+					healthChecks[u] = hc
+				}
+			}
+			return
+		})
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Can't load backend %s", name)
+			return
+		}
+
+		rt.name = name
+		rt.forceHTTPS = be.ForceHTTPS
+		rt.passthrough = be.TLSPassthrough
+		if be.TLSPassthrough && (be.TLS != nil || be.ClientAuth != nil) {
+			err = errors.Errorf(
+				"Can't load backend %s: tls_passthrough can't be "+
+					"combined with tls nor client_auth", name)
+			return
+		}
+		if be.TLSPassthrough && len(be.Routes) > 0 {
+			err = errors.Errorf(
+				"Can't load backend %s: routes don't apply to "+
+					"tls_passthrough backends", name)
+			return
+		}
+		if be.ClientAuth != nil {
+			rt.clientAuth = new(ClientAuth)
+			*rt.clientAuth = *be.ClientAuth
+			err = rt.clientAuth.prepare()
+			if err != nil {
+				err = errors.Wrapf(err,
+					"Can't load backend %s", name)
+				return
+			}
+		}
+		if be.HSTS != nil {
+			rt.hsts = new(HSTS)
+			*rt.hsts = *be.HSTS
+			err = rt.hsts.prepare()
+			if err != nil {
+				err = errors.Wrapf(err,
+					"Can't load backend %s", name)
+				return
+			}
+		}
+		if be.TLS != nil {
+			rt.certificate, err = loadCertificate(be.TLS.Cert, be.TLS.Key)
+			if err != nil {
+				err = errors.Wrapf(err,
+					"Can't load backend %s", name)
+				return
+			}
+		}
+
+		err = internalBackends.add(name, rt)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Can't load backend %s", name)
+			return
 		}
 
 		lb.logger.Debug().
 			Str("backend", name).
 			Msg("backend loaded")
-		internalBackends[name] = lbc
 	}
 
-	lb.publicBackends = backends
+	internalBackends.sort()
+
+	compiled = &compiledBackends{
+		public:       backends,
+		hosts:        internalBackends,
+		upstreams:    upstreams,
+		previous:     previousUpstreams,
+		healthChecks: healthChecks,
+	}
+	return
+}
+
+// newPool creates a pool that spreads the requests across the
+// servers specified, reusing the upstreams that were already
+// known (`previous`) and registering them in `current`.
+//
+// `https` servers are reached over TLS as configured by `ut`;
+// their upstreams are only reused if that didn't change.
+//
+// A nil pool is returned if no servers are specified.
+func (lb *L7) newPool(name, algorithm, protocol string, servers []Server, ut *UpstreamTLS,
+	previous, current map[string]*upstream) (p *pool, err error) {
+	var (
+		url     string
+		key     string
+		u       *upstream
+		found   bool
+		weights []int
+
+		serverTLS *UpstreamTLS
+	)
+
+	if len(servers) == 0 {
+		lb.logger.Debug().Str("backend", name).Msg("no servers")
+		return
+	}
+
+	p = &pool{
+		backend: name,
+		logger: lb.logger.With().
+			Str("backend", name).
+			Logger(),
+	}
+	for _, server := range servers {
+		key, url, err = upstreamKey(name, server.Address)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Can't use address %s as a server address",
+				server.Address)
+			return
+		}
+
+		serverTLS = nil
+		if IsTLSAddress(server.Address) {
+			serverTLS = ut
+		}
+
+		u, found = current[key]
+		if !found {
+			u, found = previous[key]
+			if !found || (serverTLS != nil && u.tls != serverTLS.fingerprint) ||
+				(u.transport != nil) != (protocol == PROTOCOL_GRPC) {
+				u = newUpstream(url, serverTLS)
+				if protocol == PROTOCOL_GRPC {
+					u.transport = newGRPCTransport(serverTLS)
+				}
+			}
+			current[key] = u
+		}
+
+		lb.logger.Debug().
+			Str("backend", name).
+			Str("server", url).
+			Msg("server loaded")
+
+		if server.Weight < 0 {
+			err = errors.Errorf(
+				"Server %s can't have a negative weight",
+				server.Address)
+			return
+		}
+
+		if server.Weight == 0 {
+			server.Weight = 1
+		}
+
+		p.upstreams = append(p.upstreams, u)
+		weights = append(weights, server.Weight)
+	}
+
+	p.balancer, err = newBalancer(algorithm, p.upstreams, weights)
+	return
+}
+
+// upstreamKey identifies the upstream of a backend that
+// corresponds to a server address.
+func upstreamKey(backend, address string) (key, url string, err error) {
+	url, err = NormalizeAddress(address)
+	if err != nil {
+		return
+	}
+
+	key = backend + "|http://" + url
+	if IsTLSAddress(address) {
+		key = backend + "|https://" + url
+	}
 
-	lb.Lock()
-	defer lb.Unlock()
-	lb.backends = internalBackends
 	return
 }
 
@@ -142,6 +591,24 @@ func (lb *L7) GetBackends() map[string]Backend {
 	return lb.publicBackends
 }
 
+// GetServerStatus retrieves the status of a server from a
+// given backend as seen by the load-balancer.
+func (lb *L7) GetServerStatus(backend, address string) string {
+	key, _, err := upstreamKey(backend, address)
+	if err != nil {
+		return "invalid"
+	}
+
+	lb.RLock()
+	u, found := lb.upstreams[key]
+	lb.RUnlock()
+	if !found {
+		return "unknown"
+	}
+
+	return u.status()
+}
+
 var (
 	authorizationHeader = []byte("Authorization")
 	authenticateHeader  = []byte("WWW-Authenticate")
@@ -158,6 +625,7 @@ func (lb *L7) authenticate(ctx *fasthttp.RequestCtx) (ok bool) {
 	if len(auth) == 0 {
 		lb.logger.Info().
 			Uint64("id", ctx.ConnID()).
+			Str("request_id", requestIDOf(ctx)).
 			Msg("auth header required but not present")
 
 		ctx.Response.Header.SetBytesKV(
@@ -168,6 +636,8 @@ func (lb *L7) authenticate(ctx *fasthttp.RequestCtx) (ok bool) {
 
 	for _, usr := range lb.users {
 		lb.logger.Info().
+			Uint64("id", ctx.ConnID()).
+			Str("request_id", requestIDOf(ctx)).
 			Bytes("usr", usr).
 			Bytes("auth", auth).
 			Msg("checking")
@@ -175,6 +645,7 @@ func (lb *L7) authenticate(ctx *fasthttp.RequestCtx) (ok bool) {
 		if bytes.Equal(auth, usr) {
 			lb.logger.Debug().
 				Uint64("id", ctx.ConnID()).
+				Str("request_id", requestIDOf(ctx)).
 				Msg("authentication succeeded")
 			ok = true
 			return
@@ -183,43 +654,70 @@ func (lb *L7) authenticate(ctx *fasthttp.RequestCtx) (ok bool) {
 
 	lb.logger.Info().
 		Uint64("id", ctx.ConnID()).
+		Str("request_id", requestIDOf(ctx)).
 		Msg("no allowed user found")
 	return
 }
 
-func (lb *L7) route(ctx *fasthttp.RequestCtx) {
-	var (
-		ndx int
-		b   byte
-	)
-
-	for ndx, b = range ctx.Host() {
-		if b == ':' {
-			ndx--
-			break
-		}
-	}
-	ndx++
-
+// route forwards the request to the backend `rt` (nil
+// if no backend matches the host of the request).
+func (lb *L7) route(ctx *fasthttp.RequestCtx, rt *routeTable) {
 	var logger = lb.logger.With().
 		Uint64("id", ctx.ConnID()).
-		Bytes("host", ctx.Host()[:ndx]).
+		Str("request_id", requestIDOf(ctx)).
+		Bytes("host", hostWithoutPort(ctx.Host())).
 		Bytes("method", ctx.Request.Header.Method()).
 		Bytes("uri", ctx.Request.RequestURI()).
 		Logger()
 
+	if subject, ok := ctx.UserValue(clientSubjectKey).(string); ok {
+		logger = logger.With().
+			Str("client", subject).
+			Logger()
+	}
+
 	logger.Debug().
 		Msg("routing")
 
-	lb.RLock()
-	backend, found := lb.backends[string(ctx.Host()[:ndx])]
-	lb.RUnlock()
-	if !found {
+	if rt == nil {
 		logger.Warn().
 			Msg("backend not found")
 		ctx.SetStatusCode(fasthttp.StatusNotFound)
 		return
 	}
+
+	r, found := rt.match(ctx.Path())
+	if !found {
+		logger.Warn().
+			Msg("route not found")
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	logger = logger.With().
+		Str("backend", rt.name).
+		Str("route", r.name).
+		Logger()
+
+	if r.redirect != nil {
+		r.redirect.write(ctx, r.regex)
+		logger.Debug().
+			Bytes("location", ctx.Response.Header.PeekBytes(locationHeader)).
+			Msg("redirecting")
+		rt.addHSTS(ctx)
+		return
+	}
+
+	if r.response != nil {
+		logger.Debug().
+			Int("status", r.response.Status).
+			Msg("sending fixed response")
+		r.response.write(ctx)
+		rt.addHSTS(ctx)
+		return
+	}
+
+	backend := r.pool
 	if backend == nil {
 		logger.Warn().
 			Msg("no servers in backend")
@@ -227,39 +725,119 @@ func (lb *L7) route(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	ctx.Request.Header.DelBytes(connectionHeader)
-	err := backend.Do(&ctx.Request, &ctx.Response)
-	if err != nil {
+	lb.forwarded.apply(ctx)
+	if r.rewrite != nil {
+		r.rewrite.apply(ctx)
+	}
+
+	var err error
+	if backend.protocol == PROTOCOL_GRPC {
+		err = lb.proxyGRPC(ctx, backend)
+	} else if isUpgrade(ctx) {
+		stripHopByHop(&ctx.Request.Header, upgradeHeaders)
+		err = lb.proxyUpgrade(ctx, backend)
+		if ctx.Response.StatusCode() == fasthttp.StatusSwitchingProtocols {
+			stripHopByHop(&ctx.Response.Header, upgradeHeaders)
+		} else {
+			stripHopByHop(&ctx.Response.Header, nil)
+		}
+	} else {
+		stripHopByHop(&ctx.Request.Header, nil)
+		err = backend.Do(ctx)
+		stripHopByHop(&ctx.Response.Header, nil)
+	}
+
+	if err == ErrNoHealthyServers {
+		logger.Warn().
+			Msg("no healthy servers in backend")
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	} else if err != nil {
 		logger.Warn().
 			Msg("bad gateway")
 		ctx.SetStatusCode(fasthttp.StatusBadGateway)
 	}
-	ctx.Response.Header.DelBytes(connectionHeader)
+
+	rt.addHSTS(ctx)
 }
 
 func (lb *L7) handler(ctx *fasthttp.RequestCtx) {
-	var t = time.Now()
+	var (
+		t          = time.Now()
+		rt         *routeTable
+		identified bool
+		ok         bool
+	)
+
+	atomic.AddInt64(&lb.conns.inFlight, 1)
+	defer atomic.AddInt64(&lb.conns.inFlight, -1)
+
+	id := lb.requestID.assign(ctx)
+
+	lb.RLock()
+	rt, _ = lb.backends.match(hostWithoutPort(ctx.Host()))
+	lb.RUnlock()
+
+	// redirecting comes first so that credentials are
+	// never required over plaintext.
+	if lb.redirectToHTTPS(ctx, rt) {
+		goto END
+	}
 
-	if len(lb.users) > 0 {
+	identified, ok = lb.authenticateClient(ctx, rt)
+	if !ok {
+		goto END
+	}
+
+	// clients identified by their certificates don't
+	// need to authenticate again.
+	if len(lb.users) > 0 && !identified {
 		if !lb.authenticate(ctx) {
 			lb.logger.Info().
 				Uint64("id", ctx.ConnID()).
+				Str("request_id", id).
 				Msg("required authentication failed")
 			goto END
 		}
+
+		if lb.stripAuth {
+			delHeaders(&ctx.Request.Header, func(name string) bool {
+				return name == "Authorization"
+			})
+		}
 	}
 
-	lb.route(ctx)
+	lb.route(ctx, rt)
 
 END:
+	ctx.Response.Header.SetBytesK(lb.requestID.header, id)
+
+	// keep-alive connections are closed once
+	// their current request is served.
+	if lb.conns.isDraining() && !ctx.Hijacked() {
+		ctx.SetConnectionClose()
+	}
+
 	lb.logger.Debug().
 		Uint64("id", ctx.ConnID()).
+		Str("request_id", id).
 		Int64("μ", int64(time.Since(t).Nanoseconds()/1000)).
 		Msg("finished")
 }
 
+// newServer creates the server that handles the HTTP/1.x
+// connections of a listener: fasthttp servers keep state of
+// their own and so can't be shared.
+func (lb *L7) newServer() *fasthttp.Server {
+	return &fasthttp.Server{
+		Name:                          "cirocosta/l7",
+		DisableHeaderNamesNormalizing: true,
+		MaxRequestBodySize:            maxRequestBodySize,
+		Handler:                       lb.handler,
+	}
+}
+
 func (lb *L7) Listen() (err error) {
-	ln, err := net.Listen("tcp4", fmt.Sprintf(":%d", lb.port))
+	ln, err := lb.listen(httpListenerName, lb.port)
 	if err != nil {
 		err = errors.Wrapf(err,
 			"couldn't listen on port %d",
@@ -267,14 +845,79 @@ func (lb *L7) Listen() (err error) {
 		return
 	}
 
+	lb.Lock()
 	lb.port = ln.Addr().(*net.TCPAddr).Port
-	lb.listener = ln
+	lb.listener = &trackingListener{Listener: ln, tracker: lb.conns}
+	lb.Unlock()
+
+	tcpListeners, err := lb.listenTCP()
+	if err != nil {
+		ln.Close()
+		return
+	}
+
+	lb.Lock()
+	lb.tcpListeners = tcpListeners
+	lb.Unlock()
+
+	var (
+		errs = make(chan error, 4+len(lb.tcpListeners))
+		h2c  protocolClassifier
+	)
+
+	if lb.http2 != nil {
+		lb.h2Server = lb.newHTTP2Server(lb.http2)
+		if lb.http2.H2C {
+			h2c = detectPriorKnowledge
+		}
+	}
+
+	lb.RLock()
+	withTLS := lb.tlsConfig != nil
+	lb.RUnlock()
+
+	if withTLS {
+		tlsLn, err := lb.listen(tlsListenerName, lb.tlsPort)
+		if err != nil {
+			ln.Close()
+			for _, l := range lb.tcpListeners {
+				l.Close()
+			}
+			err = errors.Wrapf(err,
+				"couldn't listen on tls port %d",
+				lb.tlsPort)
+			return err
+		}
+
+		lb.Lock()
+		lb.tlsPort = tlsLn.Addr().(*net.TCPAddr).Port
+		lb.tlsListener = &trackingListener{Listener: tlsLn, tracker: lb.conns}
+		lb.Unlock()
+
+		terminated := newChanListener(lb.tlsListener.Addr())
+		go lb.dispatchTLS(lb.tlsListener, terminated, &tls.Config{
+			GetConfigForClient: lb.getConfigForClient,
+		})
+		go lb.serve(lb.newServer(), terminated, negotiateProtocol, errs)
+	}
+
+	for _, l := range lb.tcpListeners {
+		go func(l *tcpListener) {
+			errs <- lb.serveTCP(l)
+		}(l)
+	}
+
+	go lb.serve(lb.newServer(), lb.listener, h2c, errs)
+
+	lb.notifyReady()
+
+	err = <-errs
+	if lb.conns.isDraining() {
+		<-lb.conns.drained
+		err = nil
+		return
+	}
 
-	err = (&fasthttp.Server{
-		Name: "cirocosta/l7",
-		DisableHeaderNamesNormalizing: true,
-		Handler: lb.handler,
-	}).Serve(ln)
 	if err != nil {
 		err = errors.Wrapf(err,
 			"couldn't serve http handler")
@@ -283,10 +926,3 @@ func (lb *L7) Listen() (err error) {
 
 	return
 }
-
-// TODO implement gracefull shutdown
-func (lb *L7) Stop() {
-	if lb.listener != nil {
-		lb.listener.Close()
-	}
-}
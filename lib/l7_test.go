@@ -221,7 +221,7 @@ func Test_configurationReloading(t *testing.T) {
 	var backends = map[string]Backend{
 		"something.com": Backend{
 			Servers: []Server{
-				{server1.URL},
+				{Address: server1.URL},
 			},
 		},
 	}
@@ -245,7 +245,7 @@ func Test_configurationReloading(t *testing.T) {
 			err = lb.LoadBackends(map[string]Backend{
 				"something.com": Backend{
 					Servers: []Server{
-						{server2.URL},
+						{Address: server2.URL},
 					},
 				},
 			})
@@ -294,7 +294,7 @@ func Test_reconfigures(t *testing.T) {
 			err := lb.LoadBackends(map[string]Backend{
 				"something.com": Backend{
 					Servers: []Server{
-						{serversToChoose[i%2]},
+						{Address: serversToChoose[i%2]},
 					},
 				},
 			})
@@ -496,3 +496,251 @@ func Test_respondsWithAccordinglyIfAuthenticated(t *testing.T) {
 
 	assert.Equal(t, "myserver", string(data))
 }
+
+func Test_routesRequestsByPath(t *testing.T) {
+	var server1 = createServer("default")
+	var server2 = createServer("api")
+	var server3 = createServer("health")
+
+	defer server1.Close()
+	defer server2.Close()
+	defer server3.Close()
+
+	lb, err := New(Config{
+		Backends: map[string]Backend{
+			"something.com": Backend{
+				Servers: []Server{{Address: server1.URL}},
+				Routes: []Route{
+					{Prefix: "/api", Servers: []Server{{Address: server2.URL}}},
+					{Path: "/api/health", Servers: []Server{{Address: server3.URL}}},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var testCases = map[string]string{
+		"/":              "default",
+		"/users":         "default",
+		"/api/users?a=b": "api",
+		"/api/health":    "health",
+	}
+
+	for path, expected := range testCases {
+		req, err := http.NewRequest("GET",
+			fmt.Sprintf("http://localhost:%d%s", lb.port, path), nil)
+		assert.NoError(t, err)
+		req.Host = "something.com"
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		data, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+}
+
+func Test_routesUnknownHostsToDefaultBackend(t *testing.T) {
+	var server1 = createServer("wildcard")
+	var server2 = createServer("default")
+
+	defer server1.Close()
+	defer server2.Close()
+
+	lb, err := New(Config{
+		Backends: map[string]Backend{
+			"*.something.com": Backend{
+				Servers: []Server{{Address: server1.URL}},
+			},
+			DEFAULT_BACKEND: Backend{
+				Servers: []Server{{Address: server2.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var testCases = map[string]string{
+		"www.something.com": "wildcard",
+		"something.com":     "default",
+		"other.com":         "default",
+	}
+
+	for host, expected := range testCases {
+		resp, err := targetHost(host, lb.port)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		data, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+}
+
+func Test_removesUnhealthyServersFromRotation(t *testing.T) {
+	var healthy = createServer("healthy")
+	var unhealthy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(503)
+			return
+		}
+		fmt.Fprintf(w, "unhealthy")
+	}))
+
+	defer healthy.Close()
+	defer unhealthy.Close()
+
+	var backends = map[string]Backend{
+		"something.com": Backend{
+			Servers: []Server{{Address: healthy.URL}, {Address: unhealthy.URL}},
+			HealthCheck: &HealthCheck{
+				Path:               "/health",
+				Interval:           10 * time.Millisecond,
+				UnhealthyThreshold: 1,
+			},
+		},
+	}
+
+	lb, err := New(Config{Backends: backends})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "unhealthy", lb.GetServerStatus("something.com", unhealthy.URL))
+	assert.Equal(t, "healthy", lb.GetServerStatus("something.com", healthy.URL))
+
+	for i := 0; i < 10; i++ {
+		resp, err := targetHost("something.com", lb.port)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		data, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "healthy", string(data))
+	}
+
+	// the health state survives a reload given that the
+	// address of the server didn't change.
+	backends["something.com"].HealthCheck.Interval = time.Hour
+	assert.NoError(t, lb.LoadBackends(backends))
+	assert.Equal(t, "unhealthy", lb.GetServerStatus("something.com", unhealthy.URL))
+}
+
+func Test_ejectsFailingServers(t *testing.T) {
+	var healthy = createServer("healthy")
+	var failing = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+
+	defer healthy.Close()
+	defer failing.Close()
+
+	lb, err := New(Config{
+		Backends: map[string]Backend{
+			"something.com": Backend{
+				Servers: []Server{{Address: healthy.URL}, {Address: failing.URL}},
+				OutlierDetection: &OutlierDetection{
+					ConsecutiveFailures: 2,
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var failures = 0
+	for i := 0; i < 20; i++ {
+		resp, err := targetHost("something.com", lb.port)
+		assert.NoError(t, err)
+		if resp.StatusCode == 500 {
+			failures++
+		}
+	}
+
+	assert.Equal(t, 2, failures)
+	assert.Equal(t, "ejected", lb.GetServerStatus("something.com", failing.URL))
+}
+
+func Test_stickySessions(t *testing.T) {
+	var server1 = createServer("server1")
+	var server2 = createServer("server2")
+
+	defer server1.Close()
+	defer server2.Close()
+
+	var backends = map[string]Backend{
+		"something.com": Backend{
+			Servers: []Server{
+				{Address: server1.URL},
+				{Address: server2.URL},
+			},
+			Sticky: &Sticky{Cookie: "affinity"},
+		},
+	}
+
+	lb, err := New(Config{Backends: backends})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := targetHost("something.com", lb.port)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	var (
+		first   = string(data)
+		cookies = resp.Cookies()
+	)
+
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, "affinity", cookies[0].Name)
+
+	for i := 0; i < 10; i++ {
+		req, err := http.NewRequest("GET",
+			fmt.Sprintf("http://localhost:%d", lb.port), nil)
+		assert.NoError(t, err)
+		req.Host = "something.com"
+		req.AddCookie(cookies[0])
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Empty(t, resp.Cookies())
+
+		data, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, first, string(data))
+	}
+}
@@ -0,0 +1,213 @@
+package lib
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_OUTLIER_CONSECUTIVE_FAILURES = 5
+	DEFAULT_OUTLIER_MINIMUM_REQUESTS     = 10
+	DEFAULT_OUTLIER_WINDOW               = 10 * time.Second
+	DEFAULT_OUTLIER_BASE_EJECTION_TIME   = 30 * time.Second
+	DEFAULT_OUTLIER_MAX_EJECTION_TIME    = 300 * time.Second
+	DEFAULT_OUTLIER_MAX_EJECTION_PERCENT = 50
+)
+
+// OutlierDetection configures the passive detection of failing
+// servers based on the results of the requests proxied to them.
+//
+// A request fails if the server can't be reached, doesn't answer
+// in time or answers with a 5xx status. A server gets temporarily
+// ejected from the pool once it fails `ConsecutiveFailures` times
+// in a row or once the percentage of failed requests within
+// `Window` reaches `ErrorRate` (given that at least
+// `MinimumRequests` were made).
+//
+// Each consecutive ejection doubles the ejection time, starting
+// from `BaseEjectionTime` and capped at `MaxEjectionTime`.
+//
+// `MaxEjectionPercent` is a pointer so that an explicit 0 (never
+// eject) can be told apart from it not being specified.
+type OutlierDetection struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"`
+	ErrorRate           int           `yaml:"error_rate"`
+	MinimumRequests     int           `yaml:"minimum_requests"`
+	Window              time.Duration `yaml:"window"`
+	BaseEjectionTime    time.Duration `yaml:"base_ejection_time"`
+	MaxEjectionTime     time.Duration `yaml:"max_ejection_time"`
+	MaxEjectionPercent  *int          `yaml:"max_ejection_percent"`
+
+	maxEjectionPercent int
+}
+
+// prepare fills the fields not specified with their
+// defaults and validates the configuration.
+func (od *OutlierDetection) prepare() (err error) {
+	if od.ConsecutiveFailures == 0 {
+		od.ConsecutiveFailures = DEFAULT_OUTLIER_CONSECUTIVE_FAILURES
+	}
+
+	if od.MinimumRequests == 0 {
+		od.MinimumRequests = DEFAULT_OUTLIER_MINIMUM_REQUESTS
+	}
+
+	if od.Window == 0 {
+		od.Window = DEFAULT_OUTLIER_WINDOW
+	}
+
+	if od.BaseEjectionTime == 0 {
+		od.BaseEjectionTime = DEFAULT_OUTLIER_BASE_EJECTION_TIME
+	}
+
+	if od.MaxEjectionTime == 0 {
+		od.MaxEjectionTime = DEFAULT_OUTLIER_MAX_EJECTION_TIME
+	}
+
+	od.maxEjectionPercent = DEFAULT_OUTLIER_MAX_EJECTION_PERCENT
+	if od.MaxEjectionPercent != nil {
+		od.maxEjectionPercent = *od.MaxEjectionPercent
+	}
+
+	if od.ConsecutiveFailures < 0 || od.MinimumRequests < 0 ||
+		od.Window < 0 || od.BaseEjectionTime < 0 {
+		err = errors.Errorf(
+			"outlier detection thresholds and times must be positive")
+		return
+	}
+
+	if od.ErrorRate < 0 || od.ErrorRate > 100 ||
+		od.maxEjectionPercent < 0 || od.maxEjectionPercent > 100 {
+		err = errors.Errorf(
+			"outlier detection percentages must be within 0-100")
+		return
+	}
+
+	if od.MaxEjectionTime < od.BaseEjectionTime {
+		err = errors.Errorf(
+			"outlier detection max ejection time must not be " +
+				"smaller than the base ejection time")
+		return
+	}
+
+	return
+}
+
+// outlierState keeps track of the results of the requests
+// made to an upstream.
+type outlierState struct {
+	sync.Mutex
+
+	consecutiveFailures int
+	requests            int
+	failures            int
+	windowStart         time.Time
+
+	ejections    int
+	ejectedUntil int64
+}
+
+func (u *upstream) isEjected(now time.Time) bool {
+	return atomic.LoadInt64(&u.outliers.ejectedUntil) > now.UnixNano()
+}
+
+// record accounts for the result of a request made to the upstream,
+// telling whether the upstream should be ejected.
+func (u *upstream) record(od *OutlierDetection, failed bool, now time.Time) (eject bool) {
+	var s = &u.outliers
+
+	s.Lock()
+	defer s.Unlock()
+
+	if now.Sub(s.windowStart) > od.Window {
+		s.windowStart = now
+		s.requests = 0
+		s.failures = 0
+	}
+
+	s.requests++
+	if !failed {
+		s.consecutiveFailures = 0
+		return
+	}
+
+	s.failures++
+	s.consecutiveFailures++
+
+	eject = s.consecutiveFailures >= od.ConsecutiveFailures ||
+		(od.ErrorRate > 0 && s.requests >= od.MinimumRequests &&
+			s.failures*100 >= od.ErrorRate*s.requests)
+	return
+}
+
+// eject removes the upstream from rotation, returning for
+// how long it'll stay out.
+func (u *upstream) eject(od *OutlierDetection, now time.Time) (duration time.Duration) {
+	var s = &u.outliers
+
+	s.Lock()
+	defer s.Unlock()
+
+	// the backoff is reset once the upstream
+	// has behaved for long enough.
+	if now.UnixNano()-s.ejectedUntil > int64(od.MaxEjectionTime) {
+		s.ejections = 0
+	}
+
+	duration = od.BaseEjectionTime << uint(s.ejections)
+	if duration > od.MaxEjectionTime || duration <= 0 {
+		duration = od.MaxEjectionTime
+	}
+
+	s.ejections++
+	s.consecutiveFailures = 0
+	s.requests = 0
+	s.failures = 0
+	s.windowStart = now
+	atomic.StoreInt64(&s.ejectedUntil, now.Add(duration).UnixNano())
+	return
+}
+
+// observe takes the result of a request made to one of the
+// upstreams of the pool into account, ejecting it in case
+// it's considered an outlier.
+func (p *pool) observe(u *upstream, failed bool) {
+	var (
+		od      = p.outlierDetection
+		now     = time.Now()
+		ejected int
+	)
+
+	if od == nil || !u.record(od, failed, now) {
+		return
+	}
+
+	p.ejectionMu.Lock()
+	defer p.ejectionMu.Unlock()
+
+	if u.isEjected(now) {
+		return
+	}
+
+	for _, candidate := range p.upstreams {
+		if candidate.isEjected(now) {
+			ejected++
+		}
+	}
+
+	if (ejected+1)*100 > od.maxEjectionPercent*len(p.upstreams) {
+		p.logger.Warn().
+			Str("server", u.address).
+			Int("ejected", ejected).
+			Msg("max ejection percent reached, not ejecting server")
+		return
+	}
+
+	p.logger.Warn().
+		Str("server", u.address).
+		Dur("duration", u.eject(od, now)).
+		Msg("server ejected")
+}
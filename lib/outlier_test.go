@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func newInt(value int) *int {
+	return &value
+}
+
+func TestOutlierDetection_prepareMaxEjectionPercent(t *testing.T) {
+	var od = &OutlierDetection{}
+	assert.NoError(t, od.prepare())
+	assert.Equal(t, DEFAULT_OUTLIER_MAX_EJECTION_PERCENT, od.maxEjectionPercent)
+
+	od = &OutlierDetection{MaxEjectionPercent: newInt(0)}
+	assert.NoError(t, od.prepare())
+	assert.Equal(t, 0, od.maxEjectionPercent)
+
+	od = &OutlierDetection{MaxEjectionPercent: newInt(101)}
+	assert.Error(t, od.prepare())
+}
+
+func TestUpstream_recordConsecutiveFailures(t *testing.T) {
+	var (
+		u   = newUpstream("a:80", nil)
+		now = time.Now()
+		od  = &OutlierDetection{ConsecutiveFailures: 3}
+	)
+
+	assert.NoError(t, od.prepare())
+	assert.False(t, u.record(od, true, now))
+	assert.False(t, u.record(od, true, now))
+	assert.False(t, u.record(od, false, now))
+	assert.False(t, u.record(od, true, now))
+	assert.False(t, u.record(od, true, now))
+	assert.True(t, u.record(od, true, now))
+}
+
+func TestUpstream_recordErrorRate(t *testing.T) {
+	var (
+		u   = newUpstream("a:80", nil)
+		now = time.Now()
+		od  = &OutlierDetection{
+			ConsecutiveFailures: 100,
+			ErrorRate:           50,
+			MinimumRequests:     4,
+			Window:              time.Second,
+		}
+	)
+
+	assert.NoError(t, od.prepare())
+	assert.False(t, u.record(od, true, now))
+	assert.False(t, u.record(od, false, now))
+	assert.False(t, u.record(od, false, now))
+	assert.True(t, u.record(od, true, now))
+
+	// a new window starts from scratch
+	now = now.Add(2 * time.Second)
+	assert.False(t, u.record(od, false, now))
+	assert.False(t, u.record(od, false, now))
+	assert.False(t, u.record(od, false, now))
+	assert.False(t, u.record(od, true, now))
+}
+
+func TestUpstream_ejectBacksOffExponentially(t *testing.T) {
+	var (
+		u   = newUpstream("a:80", nil)
+		now = time.Now()
+		od  = &OutlierDetection{
+			BaseEjectionTime: time.Second,
+			MaxEjectionTime:  5 * time.Second,
+		}
+	)
+
+	assert.NoError(t, od.prepare())
+	for _, expected := range []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second,
+		5 * time.Second,
+	} {
+		assert.Equal(t, expected, u.eject(od, now))
+		assert.True(t, u.isEjected(now))
+		now = now.Add(expected)
+		assert.False(t, u.isEjected(now))
+	}
+
+	// behaving for longer than the max ejection
+	// time resets the backoff.
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, time.Second, u.eject(od, now))
+}
+
+func TestPool_observeRespectsMaxEjectionPercent(t *testing.T) {
+	var p = &pool{
+		logger: zerolog.Nop(),
+		upstreams: []*upstream{
+			newUpstream("a:80", nil),
+			newUpstream("b:80", nil),
+			newUpstream("c:80", nil),
+			newUpstream("d:80", nil),
+		},
+		outlierDetection: &OutlierDetection{
+			ConsecutiveFailures: 1,
+			MaxEjectionPercent:  newInt(50),
+		},
+	}
+
+	assert.NoError(t, p.outlierDetection.prepare())
+	for _, u := range p.upstreams {
+		p.observe(u, true)
+	}
+
+	var now = time.Now()
+	assert.True(t, p.upstreams[0].isEjected(now))
+	assert.True(t, p.upstreams[1].isEjected(now))
+	assert.False(t, p.upstreams[2].isEjected(now))
+	assert.False(t, p.upstreams[3].isEjected(now))
+	assert.Equal(t, "ejected", p.upstreams[0].status())
+}
+
+func TestPool_observeNeverEjectsWithZeroMaxEjectionPercent(t *testing.T) {
+	var p = &pool{
+		logger: zerolog.Nop(),
+		upstreams: []*upstream{
+			newUpstream("a:80", nil),
+			newUpstream("b:80", nil),
+		},
+		outlierDetection: &OutlierDetection{
+			ConsecutiveFailures: 1,
+			MaxEjectionPercent:  newInt(0),
+		},
+	}
+
+	assert.NoError(t, p.outlierDetection.prepare())
+	for _, u := range p.upstreams {
+		p.observe(u, true)
+	}
+
+	var now = time.Now()
+	assert.False(t, p.upstreams[0].isEjected(now))
+	assert.False(t, p.upstreams[1].isEjected(now))
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+var errClientHelloRead = errors.Errorf("client hello read")
+
+// readOnlyConn lets the handshake read from a connection
+// without ever answering it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// readServerName reads the ClientHello sent through the connection
+// to find out the SNI name asked for, returning what was read
+// so that it can be replayed.
+func readServerName(conn net.Conn) (serverName string, read *bytes.Buffer, err error) {
+	var hello bool
+
+	read = new(bytes.Buffer)
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	err = tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, read)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = true
+			serverName = strings.TrimSuffix(info.ServerName, ".")
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if hello {
+		err = nil
+	}
+
+	return
+}
+
+// passthroughPool is the pool of servers of the backend with
+// TLS passthrough matching the SNI name, if any.
+func (lb *L7) passthroughPool(serverName string) (p *pool, name string) {
+	if serverName == "" {
+		return
+	}
+
+	lb.RLock()
+	rt, _ := lb.backends.match([]byte(serverName))
+	lb.RUnlock()
+
+	if rt == nil || !rt.passthrough {
+		return
+	}
+
+	name = rt.name
+	if rt.fallback != nil {
+		p = rt.fallback.pool
+	}
+
+	return
+}
+
+// dispatchTLS accepts the connections of the TLS listener,
+// passing those meant for backends with TLS passthrough through
+// to their servers and handing the rest over to be terminated.
+func (lb *L7) dispatchTLS(ln net.Listener, terminated *chanListener, cfg *tls.Config) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			terminated.closeWith(err)
+			return
+		}
+
+		go func() {
+			serverName, read, err := readServerName(c)
+			if err != nil {
+				c.Close()
+				return
+			}
+
+			conn := &peekedConn{Conn: c, r: io.MultiReader(read, c)}
+			if p, name := lb.passthroughPool(serverName); name != "" {
+				lb.proxyPassthrough(conn, p, name, serverName)
+				return
+			}
+
+			terminated.push(tls.Server(conn, cfg))
+		}()
+	}
+}
+
+// proxyPassthrough splices the (still encrypted) connection to
+// one of the healthy servers of the backend.
+func (lb *L7) proxyPassthrough(client *peekedConn, p *pool, backend, serverName string) {
+	defer client.Close()
+	setLongLived(client)
+
+	var logger = lb.logger.With().
+		Str("backend", backend).
+		Str("sni", serverName).
+		Str("client", client.RemoteAddr().String()).
+		Logger()
+
+	if p == nil {
+		logger.Warn().
+			Msg("no servers in backend")
+		return
+	}
+
+	// the requests can't be seen: consistent hashing
+	// is done on the client address.
+	var key []byte
+	if p.hashKey != nil {
+		key = hashOnAddr(client.RemoteAddr())
+	}
+
+	u := p.pick(key)
+	if u == nil {
+		logger.Warn().
+			Msg("no healthy servers in backend")
+		return
+	}
+
+	start := time.Now()
+	// the servers speak TLS themselves.
+	server, err := dialRaw(u.address, fasthttp.DefaultLBClientTimeout,
+		p.proxyHeader(client.RemoteAddr(), client.LocalAddr()))
+	p.report(u, time.Since(start), err != nil)
+	if err != nil {
+		logger.Warn().
+			Err(err).
+			Str("server", u.address).
+			Msg("couldn't connect to server")
+		return
+	}
+
+	atomic.AddInt64(&u.conns, 1)
+	defer atomic.AddInt64(&u.conns, -1)
+
+	logger.Debug().
+		Str("server", u.address).
+		Msg("passing connection through")
+
+	splice(client, server, client, server, p.tunnelIdle)
+}
@@ -0,0 +1,235 @@
+package lib
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getOverTLS(port int, serverName string) (body string, err error) {
+	var client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				ServerName:         serverName,
+			},
+		},
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://localhost:%d", port), nil)
+	if err != nil {
+		return
+	}
+
+	req.Host = serverName
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	body = string(data)
+	return
+}
+
+func TestReadServerName(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go tls.Client(client, &tls.Config{ServerName: "example.com."}).Handshake()
+
+	serverName, read, err := readServerName(server)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", serverName)
+	assert.True(t, read.Len() > 0)
+
+	// nothing is written back
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = client.Read(make([]byte, 1))
+	assert.True(t, isTimeout(err))
+}
+
+func TestL7_passesTLSThroughBySNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l7-passthrough")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		terminated = createServer("terminated")
+		down       = createServer("down")
+	)
+	defer terminated.Close()
+	down.Close()
+
+	defaultCert, defaultKey := createCertificate(t, dir, "default")
+	upstreamCert, upstreamKey := createCertificate(t, dir, "upstream")
+
+	upstream := createTLSServer(t, "passed through", upstreamCert, upstreamKey, "")
+	defer upstream.Close()
+
+	lb, err := New(Config{
+		TLS: &TLS{Cert: defaultCert, Key: defaultKey},
+		Backends: map[string]Backend{
+			"secure.com": Backend{
+				TLSPassthrough: true,
+				Servers:        []Server{{Address: upstream.URL}},
+			},
+			"down.com": Backend{
+				TLSPassthrough: true,
+				Servers:        []Server{{Address: "https://" + down.Listener.Addr().String()}},
+			},
+			"terminated.com": Backend{
+				Servers: []Server{{Address: terminated.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	lb.tlsPort = 0
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// the servers terminate TLS themselves
+	name, err := servedCertificateName(lb.tlsPort, "secure.com", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "upstream", name)
+
+	body, err := getOverTLS(lb.tlsPort, "secure.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "passed through", body)
+
+	// other names are terminated as usual
+	name, err = servedCertificateName(lb.tlsPort, "terminated.com", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "default", name)
+
+	body, err = getOverTLS(lb.tlsPort, "terminated.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "terminated", body)
+
+	// connections to unreachable servers are closed
+	_, err = servedCertificateName(lb.tlsPort, "down.com", 0)
+	assert.Error(t, err)
+
+	// as are those that don't speak TLS
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", lb.tlsPort))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: secure.com\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err))
+}
+
+func TestL7_hashesPassedThroughConnectionsOnClientAddresses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l7-passthrough")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defaultCert, defaultKey := createCertificate(t, dir, "default")
+	upstreamCert, upstreamKey := createCertificate(t, dir, "upstream")
+
+	var (
+		servers []Server
+		names   = map[string]string{}
+	)
+
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("server-%d", i)
+		upstream := createTLSServer(t, name, upstreamCert, upstreamKey, "")
+		defer upstream.Close()
+
+		servers = append(servers, Server{Address: upstream.URL})
+		names[upstream.Listener.Addr().String()] = name
+	}
+
+	lb, err := New(Config{
+		TLS: &TLS{Cert: defaultCert, Key: defaultKey},
+		Backends: map[string]Backend{
+			"secure.com": Backend{
+				TLSPassthrough: true,
+				Algorithm:      ALGORITHM_CONSISTENT_HASH,
+				Servers:        servers,
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	lb.tlsPort = 0
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	rt, _ := lb.backends.match([]byte("secure.com"))
+	assert.NotNil(t, rt)
+
+	for i := 1; i <= 8; i++ {
+		client := fmt.Sprintf("127.0.0.%d", i)
+		expected := rt.fallback.pool.pick([]byte(client))
+
+		var transport = &http.Transport{
+			DialContext: (&net.Dialer{
+				LocalAddr: &net.TCPAddr{IP: net.ParseIP(client)},
+			}).DialContext,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				ServerName:         "secure.com",
+			},
+		}
+
+		resp, err := (&http.Client{Transport: transport}).Get(
+			fmt.Sprintf("https://127.0.0.1:%d", lb.tlsPort))
+		assert.NoError(t, err)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		transport.CloseIdleConnections()
+
+		assert.Equal(t, names[expected.address], string(body), client)
+	}
+}
+
+func TestLoadBackends_failsOnPassthroughWithCertificates(t *testing.T) {
+	var lb = L7{}
+
+	assert.Error(t, lb.LoadBackends(map[string]Backend{
+		"example.com": Backend{
+			TLSPassthrough: true,
+			TLS:            &BackendTLS{Cert: "cert.pem", Key: "key.pem"},
+		},
+	}))
+}
+
+func TestLoadBackends_failsOnPassthroughWithRoutes(t *testing.T) {
+	var lb = L7{}
+
+	assert.Error(t, lb.LoadBackends(map[string]Backend{
+		"example.com": Backend{
+			TLSPassthrough: true,
+			Servers:        []Server{{Address: "http://127.0.0.1:8443"}},
+			Routes: []Route{{
+				Path:    "/api",
+				Servers: []Server{{Address: "http://127.0.0.1:8444"}},
+			}},
+		},
+	}))
+}
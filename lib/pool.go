@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	ErrNoHealthyServers = errors.Errorf("No healthy servers available")
+)
+
+// upstream is a server that requests can be forwarded to.
+//
+// Upstreams are shared by all the routes of a backend that
+// point to the same address and are kept across configuration
+// reloads so that their state is preserved.
+type upstream struct {
+	address   string
+	client    *fasthttp.HostClient
+	transport *http.Transport
+	tls       string
+	tcp       bool
+	conns     int64
+	healthy   int32
+	outliers  outlierState
+
+	sync.Mutex
+	healthCheck *HealthCheck
+	stop        chan struct{}
+}
+
+// newUpstream creates an upstream for the server at `address`,
+// connecting to it over TLS if `ut` is given.
+func newUpstream(address string, ut *UpstreamTLS) *upstream {
+	var u = &upstream{
+		address: address,
+		healthy: 1,
+		client: &fasthttp.HostClient{
+			Addr: address,
+		},
+	}
+
+	if ut != nil {
+		u.tls = ut.fingerprint
+		u.client.IsTLS = true
+		u.client.TLSConfig = ut.config
+	}
+
+	return u
+}
+
+// scheme is the scheme of the urls used to reach the upstream.
+func (u *upstream) scheme() string {
+	if u.client != nil && u.client.IsTLS {
+		return "https"
+	}
+
+	return "http"
+}
+
+// pending is the number of requests (and of connections
+// spliced to it) the upstream is handling.
+func (u *upstream) pending() int {
+	var pending = int(atomic.LoadInt64(&u.conns))
+	if u.client != nil {
+		pending += u.client.PendingRequests()
+	}
+
+	return pending
+}
+
+func (u *upstream) isHealthy() bool {
+	return atomic.LoadInt32(&u.healthy) == 1
+}
+
+// status describes the state of the upstream.
+func (u *upstream) status() string {
+	u.Lock()
+	defer u.Unlock()
+
+	switch {
+	case !u.isHealthy():
+		return "unhealthy"
+	case u.isEjected(time.Now()):
+		return "ejected"
+	case u.healthCheck != nil:
+		return "healthy"
+	}
+
+	return "unchecked"
+}
+
+// setHealthCheck (re)starts the active health checking of the
+// upstream in case the configuration changed. A nil `hc` stops
+// it, bringing the upstream back to rotation.
+func (u *upstream) setHealthCheck(hc *HealthCheck, logger zerolog.Logger) {
+	u.Lock()
+	defer u.Unlock()
+
+	if reflect.DeepEqual(hc, u.healthCheck) {
+		return
+	}
+
+	if u.stop != nil {
+		close(u.stop)
+		u.stop = nil
+	}
+
+	u.healthCheck = hc
+	if hc == nil {
+		atomic.StoreInt32(&u.healthy, 1)
+		return
+	}
+
+	u.stop = make(chan struct{})
+	go u.runHealthCheck(hc, u.stop, logger.With().
+		Str("server", u.address).
+		Logger())
+}
+
+// pool balances requests across a set of upstreams.
+type pool struct {
+	backend          string
+	route            string
+	upstreams        []*upstream
+	balancer         balancer
+	hashKey          hashKeyFunc
+	sticky           *Sticky
+	stickyIds        map[string]*upstream
+	tunnelIdle       time.Duration
+	protocol         string
+	sendProxy        string
+	serverHost       bool
+	logger           zerolog.Logger
+	outlierDetection *OutlierDetection
+	ejectionMu       sync.Mutex
+	requestHeaders   []*headerRewrite
+	responseHeaders  []*headerRewrite
+}
+
+// pick selects one of the healthy (and not ejected) upstreams
+// according to the load-balancing algorithm of the pool.
+func (p *pool) pick(key []byte) (u *upstream) {
+	var (
+		now        = time.Now()
+		candidates = make([]*upstream, 0, len(p.upstreams))
+	)
+
+	for _, candidate := range p.upstreams {
+		if candidate.isHealthy() && !candidate.isEjected(now) {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	u = p.balancer.pick(candidates, key)
+	return
+}
+
+// choose selects the upstream that should receive the request,
+// telling whether the client should be made to stick to it.
+func (p *pool) choose(ctx *fasthttp.RequestCtx) (u *upstream, stick bool, err error) {
+	var key []byte
+
+	if p.sticky != nil {
+		u = p.stickyUpstream(ctx, time.Now())
+		stick = u == nil
+	}
+
+	if u == nil {
+		if p.hashKey != nil {
+			key = p.hashKey(ctx)
+		}
+
+		u = p.pick(key)
+		if u == nil {
+			err = ErrNoHealthyServers
+			return
+		}
+	}
+
+	return
+}
+
+// Do forwards the request to one of the healthy upstreams.
+func (p *pool) Do(ctx *fasthttp.RequestCtx) (err error) {
+	u, stick, err := p.choose(ctx)
+	if err != nil {
+		return
+	}
+
+	p.rewriteRequest(ctx, u)
+
+	start := time.Now()
+	if p.sendProxy != "" {
+		err = u.doWithProxyHeader(ctx,
+			p.proxyHeader(ctx.RemoteAddr(), ctx.LocalAddr()),
+			fasthttp.DefaultLBClientTimeout)
+	} else {
+		err = u.client.DoTimeout(&ctx.Request, &ctx.Response,
+			fasthttp.DefaultLBClientTimeout)
+	}
+	p.report(u, time.Since(start),
+		err != nil || ctx.Response.StatusCode() >= 500)
+
+	if err != nil {
+		return
+	}
+
+	p.rewriteResponse(&ctx.Response.Header, ctx, u)
+	if stick {
+		p.sticky.setCookie(ctx, u)
+	}
+
+	return
+}
+
+// proxyHeader is the PROXY protocol header to be sent to the
+// upstreams for a connection from `src` to `dst`, if any.
+func (p *pool) proxyHeader(src, dst net.Addr) []byte {
+	if p.sendProxy == "" {
+		return nil
+	}
+
+	return proxyHeader(p.sendProxy, src, dst)
+}
+
+// report lets the balancer and the outlier detection know
+// how a request forwarded to the upstream went.
+func (p *pool) report(u *upstream, elapsed time.Duration, failed bool) {
+	if o, ok := p.balancer.(balancerObserver); ok {
+		o.observe(u, elapsed, failed)
+	}
+	p.observe(u, failed)
+}
+
+// setSticky enables session affinity for the pool.
+func (p *pool) setSticky(sticky *Sticky) {
+	p.sticky = sticky
+	p.stickyIds = make(map[string]*upstream, len(p.upstreams))
+
+	for _, u := range p.upstreams {
+		p.stickyIds[sticky.id(u)] = u
+	}
+}
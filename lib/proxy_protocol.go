@@ -0,0 +1,458 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	PROXY_PROTOCOL_V1 = "v1"
+	PROXY_PROTOCOL_V2 = "v2"
+
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107
+	proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+	proxyV2MaxLength = 2048
+
+	proxyV2Local   = 0x20
+	proxyV2Proxy   = 0x21
+	proxyV2TCP4    = 0x11
+	proxyV2TCP6    = 0x21
+	proxyV2Unknown = 0x00
+)
+
+// ProxyProtocol makes the listeners accept PROXY protocol (v1
+// and v2) headers, taking the addresses they carry as those of
+// the connections.
+//
+// Headers are only looked for in the connections coming from
+// `TrustedCIDRs`, which must be specified: otherwise any client
+// could pick the address it's known by. Connections without a
+// header are served as usual.
+type ProxyProtocol struct {
+	TrustedCIDRs []string `yaml:"trusted_cidrs"`
+
+	trusted []*net.IPNet
+}
+
+// prepare parses the trusted CIDRs.
+func (pp *ProxyProtocol) prepare() (err error) {
+	if len(pp.TrustedCIDRs) == 0 {
+		err = errors.Errorf(
+			"proxy_protocol trusted_cidrs must be specified")
+		return
+	}
+
+	pp.trusted, err = parseCIDRs(pp.TrustedCIDRs)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid proxy_protocol trusted cidrs")
+	}
+
+	return
+}
+
+// trusts tells whether PROXY protocol headers are
+// accepted from `addr`.
+func (pp *ProxyProtocol) trusts(addr net.Addr) bool {
+	return containsAddr(pp.trusted, addr)
+}
+
+func parseCIDRs(cidrs []string) (networks []*net.IPNet, err error) {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err,
+				"invalid cidr %s", cidr)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return
+}
+
+// containsAddr tells whether the IP of `addr` is
+// within one of the networks.
+func containsAddr(networks []*net.IPNet, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateProxyProtocolVersion checks whether PROXY protocol
+// headers of the given version can be sent.
+func validateProxyProtocolVersion(version string) (err error) {
+	switch version {
+	case "", PROXY_PROTOCOL_V1, PROXY_PROTOCOL_V2:
+	default:
+		err = errors.Errorf(
+			"unknown proxy protocol version %s (available: %s, %s)",
+			version, PROXY_PROTOCOL_V1, PROXY_PROTOCOL_V2)
+	}
+
+	return
+}
+
+// proxyConn is a connection whose addresses were
+// given by a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r             io.Reader
+	local, remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// peekPrefix tells whether what's to be read starts with
+// `prefix`, peeking only as much as needed to find it out.
+func peekPrefix(br *bufio.Reader, prefix string) (matched bool, err error) {
+	var buf []byte
+
+	for matched = true; matched && len(buf) < len(prefix); {
+		buf, err = br.Peek(len(buf) + 1)
+		if err != nil {
+			return
+		}
+
+		matched = buf[len(buf)-1] == prefix[len(buf)-1]
+	}
+
+	return
+}
+
+// readProxyHeader reads the PROXY protocol header the connection
+// starts with (if any), returning the connection to be used
+// from then on.
+func readProxyHeader(conn net.Conn) (c net.Conn, err error) {
+	var (
+		br = bufio.NewReader(conn)
+		pc = &proxyConn{
+			Conn:   conn,
+			r:      br,
+			local:  conn.LocalAddr(),
+			remote: conn.RemoteAddr(),
+		}
+		v1, v2 bool
+	)
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		v1, err = peekPrefix(br, proxyV1Prefix)
+	case proxyV2Signature[0]:
+		v2, err = peekPrefix(br, proxyV2Signature)
+	}
+	if err != nil {
+		return
+	}
+
+	switch {
+	case v1:
+		err = pc.readV1(br)
+	case v2:
+		err = pc.readV2(br)
+	}
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid proxy protocol header from %s", conn.RemoteAddr())
+		return
+	}
+
+	c = pc
+	return
+}
+
+// readV1 reads a human-readable header, e.g.,
+// `PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n`.
+func (c *proxyConn) readV1(br *bufio.Reader) (err error) {
+	var line []byte
+
+	for len(line) <= proxyV1MaxLength {
+		var b byte
+		b, err = br.ReadByte()
+		if err != nil {
+			return
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		err = errors.Errorf("header too long")
+		return
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		err = errors.Errorf("malformed header %q", line)
+		return
+	}
+
+	c.remote, err = parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return
+	}
+
+	c.local, err = parseProxyAddr(fields[3], fields[5])
+	return
+}
+
+func parseProxyAddr(host, port string) (addr *net.TCPAddr, err error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		err = errors.Errorf("invalid address %s", host)
+		return
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		err = errors.Wrapf(err, "invalid port %s", port)
+		return
+	}
+
+	addr = &net.TCPAddr{IP: ip, Port: int(p)}
+	return
+}
+
+// readV2 reads a binary header.
+func (c *proxyConn) readV2(br *bufio.Reader) (err error) {
+	var header = make([]byte, len(proxyV2Signature)+4)
+
+	_, err = io.ReadFull(br, header)
+	if err != nil {
+		return
+	}
+
+	var (
+		command = header[12]
+		family  = header[13]
+		length  = int(binary.BigEndian.Uint16(header[14:16]))
+	)
+
+	if command>>4 != 2 {
+		err = errors.Errorf("unsupported version %d", command>>4)
+		return
+	}
+
+	if length > proxyV2MaxLength {
+		err = errors.Errorf("header too long")
+		return
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(br, payload)
+	if err != nil {
+		return
+	}
+
+	// health checks of the proxy itself (LOCAL) and
+	// unsupported families keep the actual addresses.
+	if command != proxyV2Proxy {
+		return
+	}
+
+	var size int
+	switch family {
+	case proxyV2TCP4:
+		size = net.IPv4len
+	case proxyV2TCP6:
+		size = net.IPv6len
+	default:
+		return
+	}
+
+	if length < 2*size+4 {
+		err = errors.Errorf("addresses truncated")
+		return
+	}
+
+	c.remote = &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	c.local = &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return
+}
+
+// proxyListener reads the PROXY protocol headers of the
+// connections it accepts before handing them over.
+type proxyListener struct {
+	net.Listener
+	pp    *ProxyProtocol
+	conns *chanListener
+}
+
+func newProxyListener(ln net.Listener, pp *ProxyProtocol) *proxyListener {
+	var l = &proxyListener{
+		Listener: ln,
+		pp:       pp,
+		conns:    newChanListener(ln.Addr()),
+	}
+
+	go l.serve()
+	return l
+}
+
+func (l *proxyListener) serve() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.conns.closeWith(err)
+			return
+		}
+
+		if !l.pp.trusts(c.RemoteAddr()) {
+			l.conns.push(c)
+			continue
+		}
+
+		go func() {
+			conn, err := readProxyHeader(c)
+			if err != nil {
+				c.Close()
+				return
+			}
+
+			l.conns.push(conn)
+		}()
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	return l.conns.Accept()
+}
+
+// proxyHeader creates the PROXY protocol header telling about
+// a connection from `src` to `dst`.
+func proxyHeader(version string, src, dst net.Addr) []byte {
+	var (
+		srcAddr, srcOk = src.(*net.TCPAddr)
+		dstAddr, dstOk = dst.(*net.TCPAddr)
+		known          = srcOk && dstOk &&
+			(srcAddr.IP.To4() == nil) == (dstAddr.IP.To4() == nil)
+		v4 = known && srcAddr.IP.To4() != nil
+	)
+
+	if version == PROXY_PROTOCOL_V1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family,
+			srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port))
+	}
+
+	var (
+		header  = []byte(proxyV2Signature)
+		command = byte(proxyV2Proxy)
+		family  = byte(proxyV2Unknown)
+		payload []byte
+	)
+
+	switch {
+	case !known:
+		command = proxyV2Local
+	case v4:
+		family = proxyV2TCP4
+		payload = append(payload, srcAddr.IP.To4()...)
+		payload = append(payload, dstAddr.IP.To4()...)
+	default:
+		family = proxyV2TCP6
+		payload = append(payload, srcAddr.IP.To16()...)
+		payload = append(payload, dstAddr.IP.To16()...)
+	}
+
+	if known {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(srcAddr.Port))
+		payload = binary.BigEndian.AppendUint16(payload, uint16(dstAddr.Port))
+	}
+
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// doWithProxyHeader forwards the request over a new connection
+// to the upstream, starting it with the PROXY protocol header.
+//
+// Connections can't be reused as each carries the
+// addresses of a single client.
+func (u *upstream) doWithProxyHeader(ctx *fasthttp.RequestCtx, header []byte, timeout time.Duration) (err error) {
+	conn, err := u.dial(timeout, header)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't connect to %s", u.address)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var bw = bufio.NewWriter(conn)
+
+	ctx.Request.SetConnectionClose()
+	err = ctx.Request.Write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		// responses to HEAD requests announce the length
+		// of a body they don't have.
+		ctx.Response.SkipBody = ctx.IsHead()
+		err = ctx.Response.Read(bufio.NewReader(conn))
+	}
+
+	return
+}
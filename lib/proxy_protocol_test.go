@@ -0,0 +1,257 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createProxyProtocolServer creates an HTTP server that
+// expects PROXY protocol headers, answering with the client
+// address they carry.
+func createProxyProtocolServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+
+				conn, err := readProxyHeader(c)
+				if err != nil {
+					return
+				}
+
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+
+				body := conn.RemoteAddr().String()
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", len(body))
+				if req.Method != http.MethodHead {
+					fmt.Fprint(conn, body)
+				}
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	var (
+		v4Src = &net.TCPAddr{IP: net.ParseIP("192.168.0.1").To4(), Port: 56324}
+		v4Dst = &net.TCPAddr{IP: net.ParseIP("192.168.0.11").To4(), Port: 443}
+		v6Src = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+		v6Dst = &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+		unix  = &net.UnixAddr{Name: "/tmp/socket", Net: "unix"}
+	)
+
+	var testCases = []struct {
+		desc        string
+		header      []byte
+		remote      string
+		shouldError bool
+	}{
+		{"v1 tcp4", proxyHeader(PROXY_PROTOCOL_V1, v4Src, v4Dst), "192.168.0.1:56324", false},
+		{"v1 tcp6", proxyHeader(PROXY_PROTOCOL_V1, v6Src, v6Dst), "[2001:db8::1]:56324", false},
+		{"v1 unknown", proxyHeader(PROXY_PROTOCOL_V1, unix, v4Dst), "pipe", false},
+		{"v2 tcp4", proxyHeader(PROXY_PROTOCOL_V2, v4Src, v4Dst), "192.168.0.1:56324", false},
+		{"v2 tcp6", proxyHeader(PROXY_PROTOCOL_V2, v6Src, v6Dst), "[2001:db8::1]:56324", false},
+		{"v2 local", proxyHeader(PROXY_PROTOCOL_V2, v6Src, v4Dst), "pipe", false},
+		{"no header", nil, "pipe", false},
+		{"v1 malformed", []byte("PROXY TCP4 192.168.0.1\r\n"), "", true},
+		{"v1 invalid address", []byte("PROXY TCP4 a b 1 2\r\n"), "", true},
+		{"v1 too long", append([]byte("PROXY "), make([]byte, 200)...), "", true},
+		{"v2 version", append([]byte(proxyV2Signature), 0x31, 0x11, 0, 0), "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				client.Write(tc.header)
+				client.Write([]byte("PING\r\n"))
+			}()
+
+			conn, err := readProxyHeader(server)
+			if tc.shouldError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.remote, conn.RemoteAddr().String())
+
+			// what follows the header is left to be read
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, "PING\r\n", line)
+		})
+	}
+}
+
+func TestProxyProtocol_trusts(t *testing.T) {
+	var pp = ProxyProtocol{TrustedCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}}
+	assert.NoError(t, pp.prepare())
+
+	assert.True(t, pp.trusts(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+	assert.True(t, pp.trusts(&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}))
+	assert.False(t, pp.trusts(&net.TCPAddr{IP: net.ParseIP("192.168.0.1")}))
+
+	assert.Error(t, (&ProxyProtocol{}).prepare())
+	assert.Error(t, (&ProxyProtocol{TrustedCIDRs: []string{"10.0.0.1"}}).prepare())
+}
+
+func TestL7_forwardsClientAddressesWithProxyProtocol(t *testing.T) {
+	var server = createProxyProtocolServer(t)
+	defer server.Close()
+
+	lb, err := New(Config{
+		ProxyProtocol: &ProxyProtocol{TrustedCIDRs: []string{"127.0.0.0/8"}},
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				SendProxyProtocol: PROXY_PROTOCOL_V2,
+				Servers:           []Server{{Address: server.Addr().String()}},
+			},
+		},
+		TCP: map[string]TCP{
+			"tcp": TCP{
+				Port:              freePort(t),
+				SendProxyProtocol: PROXY_PROTOCOL_V1,
+				Servers:           []Server{{Address: server.Addr().String()}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var testCases = []struct {
+		port     int
+		header   string
+		expected string
+	}{
+		{lb.port, "PROXY TCP4 203.0.113.7 10.0.0.1 40000 80\r\n", "203.0.113.7:40000"},
+		{lb.port, "", "127.0.0.1:"},
+		{tcpPort(&lb, "tcp"), "PROXY TCP6 2001:db8::7 2001:db8::1 40000 80\r\n", "[2001:db8::7]:40000"},
+	}
+
+	for _, tc := range testCases {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tc.port))
+		assert.NoError(t, err)
+
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", tc.header)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		assert.NoError(t, err)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Contains(t, string(body), tc.expected)
+
+		resp.Body.Close()
+		conn.Close()
+	}
+}
+
+func TestL7_forwardsHeadRequestsWithProxyProtocol(t *testing.T) {
+	var server = createProxyProtocolServer(t)
+	defer server.Close()
+
+	lb, err := New(Config{
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				SendProxyProtocol: PROXY_PROTOCOL_V1,
+				Servers:           []Server{{Address: server.Addr().String()}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("http://127.0.0.1:%d", lb.port), nil)
+	assert.NoError(t, err)
+	req.Host = "example.com"
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestL7_ignoresProxyProtocolFromUntrustedSources(t *testing.T) {
+	var server = createProxyProtocolServer(t)
+	defer server.Close()
+
+	lb, err := New(Config{
+		ProxyProtocol: &ProxyProtocol{TrustedCIDRs: []string{"10.0.0.0/8"}},
+		TCP: map[string]TCP{
+			"tcp": TCP{
+				Port:              freePort(t),
+				SendProxyProtocol: PROXY_PROTOCOL_V2,
+				Servers:           []Server{{Address: server.Addr().String()}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort(&lb, "tcp")))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// the header is forwarded as data, making the request invalid
+	fmt.Fprintf(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 40000 80\r\n"+
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.Error(t, err)
+}
+
+func TestLoadBackends_failsOnInvalidProxyProtocol(t *testing.T) {
+	var lb = L7{}
+
+	assert.Error(t, lb.LoadBackends(map[string]Backend{
+		"example.com": Backend{SendProxyProtocol: "v3"},
+	}))
+
+	assert.Error(t, lb.LoadBackends(map[string]Backend{
+		"example.com": Backend{Protocol: PROTOCOL_GRPC, SendProxyProtocol: PROXY_PROTOCOL_V1},
+	}))
+}
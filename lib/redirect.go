@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DEFAULT_REDIRECT_STATUS = fasthttp.StatusFound
+)
+
+// captureReference matches the references to the groups
+// captured by the regex of a route in the form of `$1`.
+var captureReference = regexp.MustCompile(`\$([0-9]+)`)
+
+// Redirect answers the requests with a redirect to `URL`
+// instead of forwarding them to servers.
+//
+// `URL` can make use of the variables of the request (e.g.,
+// `${host}` or `${path}`) as well as of the groups captured by
+// the regex of the route (`$1` or `${1}`). Unless it has a
+// query string of its own, the one of the request is kept.
+type Redirect struct {
+	URL    string `yaml:"url"`
+	Status int    `yaml:"status"`
+
+	target   headerTemplate
+	captures bool
+}
+
+// prepare fills the fields not specified with their
+// defaults and validates the configuration, `regex` being
+// the one of the route (if any).
+func (rd *Redirect) prepare(regex *regexp.Regexp) (err error) {
+	if rd.Status == 0 {
+		rd.Status = DEFAULT_REDIRECT_STATUS
+	}
+
+	switch rd.Status {
+	case fasthttp.StatusMovedPermanently, fasthttp.StatusFound,
+		fasthttp.StatusTemporaryRedirect, fasthttp.StatusPermanentRedirect:
+	default:
+		err = errors.Errorf(
+			"redirect status must be one of 301, 302, 307 or 308 (got %d)",
+			rd.Status)
+		return
+	}
+
+	if rd.URL == "" {
+		err = errors.Errorf(
+			"redirect url must be specified")
+		return
+	}
+
+	rd.target, err = parseTemplate(
+		captureReference.ReplaceAllString(rd.URL, "$${$1}"),
+		func(name string) bool {
+			group, err := strconv.Atoi(name)
+			if err != nil {
+				return requestVariables[name]
+			}
+
+			rd.captures = true
+			return regex != nil && group >= 0 && group <= regex.NumSubexp()
+		})
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid redirect url %s", rd.URL)
+		return
+	}
+
+	return
+}
+
+// location computes where the request is redirected to,
+// `regex` being the one of the route (if any).
+func (rd *Redirect) location(ctx *fasthttp.RequestCtx, regex *regexp.Regexp) string {
+	var captured [][]byte
+	if rd.captures {
+		captured = regex.FindSubmatch(ctx.Path())
+	}
+
+	location := rd.target.render(func(variable string) string {
+		group, err := strconv.Atoi(variable)
+		if err != nil {
+			return requestVariable(ctx, variable)
+		}
+
+		if group < len(captured) {
+			return string(captured[group])
+		}
+		return ""
+	})
+
+	if !strings.ContainsAny(location, "?#") {
+		if query := ctx.URI().QueryString(); len(query) > 0 {
+			location += "?" + string(query)
+		}
+	}
+
+	return location
+}
+
+// write answers the request with the redirect.
+func (rd *Redirect) write(ctx *fasthttp.RequestCtx, regex *regexp.Regexp) {
+	ctx.Response.Header.SetBytesK(locationHeader, rd.location(ctx, regex))
+	ctx.SetStatusCode(rd.Status)
+}
+
+// setRedirect makes the route redirect the requests as
+// configured by `rd` (if any).
+func (r *route) setRedirect(rd *Redirect) (err error) {
+	if rd == nil {
+		return
+	}
+
+	r.redirect = new(Redirect)
+	*r.redirect = *rd
+
+	err = r.redirect.prepare(r.regex)
+	return
+}
@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestRedirect_prepare(t *testing.T) {
+	var rd = Redirect{URL: "https://www.example.com${path}"}
+	assert.NoError(t, rd.prepare(nil))
+	assert.Equal(t, DEFAULT_REDIRECT_STATUS, rd.Status)
+
+	var regex = regexp.MustCompile(`^/users/(\d+)$`)
+
+	var testCases = []struct {
+		desc     string
+		redirect Redirect
+		regex    *regexp.Regexp
+	}{
+		{"no url", Redirect{}, nil},
+		{"invalid status", Redirect{URL: "/", Status: 200}, nil},
+		{"unknown variable", Redirect{URL: "/${server}"}, nil},
+		{"unterminated variable", Redirect{URL: "/${path"}, nil},
+		{"capture without regex", Redirect{URL: "/$1"}, nil},
+		{"group not captured", Redirect{URL: "/$2"}, regex},
+		{"group not captured in braces", Redirect{URL: "/${2}"}, regex},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Error(t, tc.redirect.prepare(tc.regex))
+		})
+	}
+}
+
+func TestRedirect_location(t *testing.T) {
+	var testCases = []struct {
+		url      string
+		regex    string
+		uri      string
+		expected string
+	}{
+		{"https://www.example.com${path}", "", "/a/b", "https://www.example.com/a/b"},
+		{"https://www.example.com${path}", "", "/a/b?c=d", "https://www.example.com/a/b?c=d"},
+		{"${scheme}://www.${host}/", "", "/", "http://www.example.com/"},
+		{"/accounts/$1", `^/users/(\d+)$`, "/users/42", "/accounts/42"},
+		{"/accounts/${1}0", `^/users/(\d+)$`, "/users/42", "/accounts/420"},
+		{"/$2/$1", `^/(\w+)/(\w+)$`, "/a/b?c=d", "/b/a?c=d"},
+		{"https://example.org$0", `^/a/b$`, "/a/b", "https://example.org/a/b"},
+		{"/search?q=new", "", "/search?q=old", "/search?q=new"},
+		{"/docs#intro", "", "/help?page=1", "/docs#intro"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			var (
+				ctx   fasthttp.RequestCtx
+				regex *regexp.Regexp
+				rd    = Redirect{URL: tc.url}
+			)
+
+			if tc.regex != "" {
+				regex = regexp.MustCompile(tc.regex)
+			}
+
+			ctx.Request.SetRequestURI(tc.uri)
+			ctx.Request.Header.SetHost("example.com:8080")
+
+			assert.NoError(t, rd.prepare(regex))
+			assert.Equal(t, tc.expected, rd.location(&ctx, regex))
+		})
+	}
+}
+
+func TestL7_redirectsAndSendsFixedResponses(t *testing.T) {
+	var server = createServer("www")
+	defer server.Close()
+
+	lb, err := New(Config{
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Redirect: &Redirect{
+					URL:    "https://www.example.com${path}",
+					Status: fasthttp.StatusMovedPermanently,
+				},
+			},
+			"www.example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+				Routes: []Route{
+					{
+						Regex: `^/old/(\w+)$`,
+						Redirect: &Redirect{
+							URL:    "/new/$1",
+							Status: fasthttp.StatusPermanentRedirect,
+						},
+					},
+					{
+						Path: "/robots.txt",
+						FixedResponse: &FixedResponse{
+							Headers: map[string]string{"content-type": "text/plain"},
+							Body:    "User-agent: *\nDisallow: /\n",
+						},
+					},
+					{
+						Path:          "/healthz",
+						FixedResponse: &FixedResponse{Status: fasthttp.StatusNoContent},
+					},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var testCases = []struct {
+		host     string
+		uri      string
+		status   int
+		location string
+		body     string
+	}{
+		{"example.com", "/a/b?c=d", 301, "https://www.example.com/a/b?c=d", ""},
+		{"www.example.com", "/old/page", 308, "/new/page", ""},
+		{"www.example.com", "/old/page/nested", 200, "", "www"},
+		{"www.example.com", "/robots.txt", 200, "", "User-agent: *\nDisallow: /\n"},
+		{"www.example.com", "/healthz", 204, "", ""},
+		{"www.example.com", "/", 200, "", "www"},
+	}
+
+	for _, tc := range testCases {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d%s", lb.port, tc.uri), nil)
+		assert.NoError(t, err)
+		req.Host = tc.host
+
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, tc.status, resp.StatusCode, tc.uri)
+		assert.Equal(t, tc.location, resp.Header.Get("Location"), tc.uri)
+		assert.Equal(t, tc.body, string(body), tc.uri)
+
+		if tc.uri == "/robots.txt" {
+			assert.Equal(t, []string{"text/plain"}, resp.Header["Content-Type"])
+		}
+	}
+}
+
+func TestLoadBackends_failsOnInvalidActions(t *testing.T) {
+	var lb = L7{}
+
+	assert.Error(t, lb.LoadBackends(map[string]Backend{
+		"example.com": Backend{
+			Servers:  []Server{{Address: "http://127.0.0.1:8080"}},
+			Redirect: &Redirect{URL: "https://www.example.com"},
+		},
+	}))
+
+	assert.Error(t, lb.LoadBackends(map[string]Backend{
+		"example.com": Backend{
+			Redirect: &Redirect{URL: "/$1"},
+		},
+	}))
+
+	assert.Error(t, lb.LoadBackends(map[string]Backend{
+		"example.com": Backend{
+			Routes: []Route{{
+				Path:          "/healthz",
+				FixedResponse: &FixedResponse{Status: 99},
+			}},
+		},
+	}))
+}
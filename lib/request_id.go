@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	REQUEST_ID_UUID = "uuid"
+	REQUEST_ID_ULID = "ulid"
+
+	DEFAULT_REQUEST_ID_HEADER = "X-Request-Id"
+	DEFAULT_REQUEST_ID_FORMAT = REQUEST_ID_UUID
+
+	// requestIDKey holds the ID of the request
+	// within the request context.
+	requestIDKey = "request_id"
+
+	requestIDMaxLength = 128
+	crockfordAlphabet  = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// RequestID configures the IDs that identify each request in
+// the logs of `l7` and of the servers.
+//
+// Requests are given a new ID (a random UUID or a ULID, as
+// per `Format`) sent to the servers and back to the clients
+// in the `Header` header. The IDs sent by clients within
+// `TrustedSources` (e.g., other proxies) are kept instead.
+type RequestID struct {
+	Header         string   `yaml:"header"`
+	Format         string   `yaml:"format"`
+	TrustedSources []string `yaml:"trusted_sources"`
+
+	header    []byte
+	canonical string
+	trusted   []*net.IPNet
+}
+
+// prepare fills the fields not specified with their
+// defaults and validates the configuration.
+func (ri *RequestID) prepare() (err error) {
+	if ri.Header == "" {
+		ri.Header = DEFAULT_REQUEST_ID_HEADER
+	}
+
+	if ri.Format == "" {
+		ri.Format = DEFAULT_REQUEST_ID_FORMAT
+	}
+
+	if !isToken(ri.Header) {
+		err = errors.Errorf(
+			"invalid request id header %q", ri.Header)
+		return
+	}
+
+	if ri.Format != REQUEST_ID_UUID && ri.Format != REQUEST_ID_ULID {
+		err = errors.Errorf(
+			"request id format must be one of '%s' or '%s' (got %s)",
+			REQUEST_ID_UUID, REQUEST_ID_ULID, ri.Format)
+		return
+	}
+
+	ri.trusted, err = parseCIDRs(ri.TrustedSources)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid request id trusted sources")
+		return
+	}
+
+	ri.header = []byte(ri.Header)
+	ri.canonical = http.CanonicalHeaderKey(ri.Header)
+	return
+}
+
+// newUUID generates a random (version 4) UUID.
+func newUUID() string {
+	var (
+		b   [16]byte
+		buf [36]byte
+	)
+
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	hex.Encode(buf[0:8], b[0:4])
+	hex.Encode(buf[9:13], b[4:6])
+	hex.Encode(buf[14:18], b[6:8])
+	hex.Encode(buf[19:23], b[8:10])
+	hex.Encode(buf[24:], b[10:])
+	buf[8], buf[13], buf[18], buf[23] = '-', '-', '-', '-'
+
+	return string(buf[:])
+}
+
+// newULID generates a ULID: the current time in milliseconds
+// followed by 80 random bits, encoded in Crockford's base32 so
+// that the IDs sort by the time they were generated at.
+func newULID(now time.Time) string {
+	var (
+		b   [16]byte
+		buf [26]byte
+	)
+
+	binary.BigEndian.PutUint64(b[:8], uint64(now.UnixNano()/int64(time.Millisecond))<<16)
+	rand.Read(b[6:])
+
+	// 128 bits take 26 characters of 5 bits, the
+	// first one holding only 3.
+	for i := len(buf) - 1; i >= 0; i-- {
+		var (
+			bit   = 128 - 5*(len(buf)-i)
+			value uint
+		)
+
+		for j := 0; j < 5; j++ {
+			if pos := bit + j; pos >= 0 && b[pos/8]&(0x80>>uint(pos%8)) != 0 {
+				value |= 1 << uint(4-j)
+			}
+		}
+
+		buf[i] = crockfordAlphabet[value]
+	}
+
+	return string(buf[:])
+}
+
+func validRequestID(id []byte) bool {
+	if len(id) == 0 || len(id) > requestIDMaxLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// assign gives the request its ID (the one sent by the client,
+// if trusted, or a new one), making it available to the servers.
+func (ri *RequestID) assign(ctx *fasthttp.RequestCtx) (id string) {
+	var incoming string
+
+	// header names aren't normalized by the server, so the
+	// IDs sent are looked for (and removed) whatever the case
+	// they were sent with.
+	if containsAddr(ri.trusted, ctx.RemoteAddr()) {
+		incoming = peekHeader(&ctx.Request.Header, ri.canonical)
+	}
+	delHeaders(&ctx.Request.Header, func(name string) bool {
+		return name == ri.canonical
+	})
+
+	if validRequestID([]byte(incoming)) {
+		id = incoming
+	} else if ri.Format == REQUEST_ID_ULID {
+		id = newULID(time.Now())
+	} else {
+		id = newUUID()
+	}
+
+	ctx.SetUserValue(requestIDKey, id)
+	ctx.Request.Header.SetBytesK(ri.header, id)
+	return
+}
+
+// requestIDOf retrieves the ID assigned to the request.
+func requestIDOf(ctx *fasthttp.RequestCtx) string {
+	id, _ := ctx.UserValue(requestIDKey).(string)
+	return id
+}
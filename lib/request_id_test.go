@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	uuidRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ulidRegexp = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+)
+
+func TestRequestID_prepare(t *testing.T) {
+	var ri = RequestID{}
+	assert.NoError(t, ri.prepare())
+	assert.Equal(t, DEFAULT_REQUEST_ID_HEADER, ri.Header)
+	assert.Equal(t, DEFAULT_REQUEST_ID_FORMAT, ri.Format)
+
+	var testCases = []RequestID{
+		{Format: "snowflake"},
+		{Header: "X Request Id"},
+		{TrustedSources: []string{"10.0.0.1"}},
+	}
+
+	for _, tc := range testCases {
+		assert.Error(t, tc.prepare(), "%+v", tc)
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	var ids = map[string]bool{}
+
+	for i := 0; i < 100; i++ {
+		id := newUUID()
+		assert.Regexp(t, uuidRegexp, id)
+		ids[id] = true
+	}
+
+	assert.Len(t, ids, 100)
+}
+
+func TestNewULID(t *testing.T) {
+	var now = time.Unix(0, 1469918176385*int64(time.Millisecond))
+
+	id := newULID(now)
+	assert.Regexp(t, ulidRegexp, id)
+	assert.Equal(t, "01ARYZ6S41", id[:10])
+
+	// later IDs sort after
+	assert.True(t, newULID(now.Add(time.Millisecond)) > id)
+}
+
+func TestRequestID_assign(t *testing.T) {
+	var (
+		trusted   = &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+		untrusted = &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	)
+
+	var testCases = []struct {
+		desc     string
+		format   string
+		remote   net.Addr
+		header   string
+		incoming string
+		kept     bool
+		pattern  *regexp.Regexp
+	}{
+		{"generated", REQUEST_ID_UUID, untrusted, "X-Request-Id", "", false, uuidRegexp},
+		{"generated ulid", REQUEST_ID_ULID, untrusted, "X-Request-Id", "", false, ulidRegexp},
+		{"untrusted", REQUEST_ID_UUID, untrusted, "X-Request-Id", "abc", false, uuidRegexp},
+		{"untrusted lowercase", REQUEST_ID_UUID, untrusted, "x-request-id", "evil", false, uuidRegexp},
+		{"trusted", REQUEST_ID_UUID, trusted, "X-Request-Id", "abc", true, nil},
+		{"trusted lowercase", REQUEST_ID_UUID, trusted, "x-request-id", "abc", true, nil},
+		{"trusted but invalid", REQUEST_ID_UUID, trusted, "X-Request-Id", "a b", false, uuidRegexp},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var ri = RequestID{
+				Format:         tc.format,
+				TrustedSources: []string{"10.0.0.0/8"},
+			}
+			assert.NoError(t, ri.prepare())
+
+			var ctx fasthttp.RequestCtx
+			ctx.Init2(&streamConn{local: trusted, remote: tc.remote},
+				fasthttpLogger{zerolog.Nop()}, false)
+			ctx.Request.Header.DisableNormalizing()
+			if tc.incoming != "" {
+				ctx.Request.Header.Set(tc.header, tc.incoming)
+			}
+
+			id := ri.assign(&ctx)
+			if tc.kept {
+				assert.Equal(t, tc.incoming, id)
+			} else {
+				assert.Regexp(t, tc.pattern, id)
+			}
+
+			assert.Equal(t, id, requestIDOf(&ctx))
+
+			var ids []string
+			ctx.Request.Header.VisitAll(func(key, value []byte) {
+				if http.CanonicalHeaderKey(string(key)) == DEFAULT_REQUEST_ID_HEADER {
+					ids = append(ids, string(value))
+				}
+			})
+			assert.Equal(t, []string{id}, ids)
+		})
+	}
+}
+
+func TestL7_propagatesRequestIDs(t *testing.T) {
+	var server = createHeadersServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		RequestID: &RequestID{
+			Header:         "X-Trace-Id",
+			TrustedSources: []string{"127.0.0.0/8"},
+		},
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	get := func(host, header, id string) (resp *http.Response) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d", lb.port), nil)
+		assert.NoError(t, err)
+
+		req.Host = host
+		if id != "" {
+			req.Header[header] = []string{id}
+		}
+
+		resp, err = http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return
+	}
+
+	// the same ID reaches the server and the client
+	resp := get("example.com", "X-Trace-Id", "")
+	assert.Regexp(t, uuidRegexp, resp.Header.Get("X-Trace-Id"))
+	assert.Equal(t, resp.Header.Get("X-Trace-Id"), resp.Header.Get("X-Echo-X-Trace-Id"))
+
+	// IDs from trusted sources are kept
+	resp = get("example.com", "X-Trace-Id", "from-upstream-proxy")
+	assert.Equal(t, "from-upstream-proxy", resp.Header.Get("X-Trace-Id"))
+	assert.Equal(t, "from-upstream-proxy", resp.Header.Get("X-Echo-X-Trace-Id"))
+
+	// whatever the case of the header they're sent in
+	resp = get("example.com", "x-trace-id", "from-upstream-proxy")
+	assert.Equal(t, "from-upstream-proxy", resp.Header.Get("X-Trace-Id"))
+	assert.Equal(t, []string{"from-upstream-proxy"}, resp.Header["X-Echo-X-Trace-Id"])
+
+	// responses given by l7 itself carry it too
+	resp = get("unknown.com", "X-Trace-Id", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Regexp(t, uuidRegexp, resp.Header.Get("X-Trace-Id"))
+}
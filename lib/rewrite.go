@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	HOST_PRESERVE = "preserve"
+	HOST_SERVER   = "server"
+
+	DEFAULT_REWRITE_HOST = HOST_PRESERVE
+)
+
+// Rewrite modifies the requests before they're forwarded to
+// the servers.
+//
+// The path is rewritten by (in order) removing `StripPrefix`,
+// replacing the matches of `Regex` by `Replacement` (which can
+// refer to the groups captured, e.g., `/v2/$1`) and prepending
+// `AddPrefix`. The query string is kept as is.
+//
+// `Host` tells whether the `Host` header sent by the client is
+// kept (`preserve`) or replaced by the address of the server
+// picked (`server`).
+type Rewrite struct {
+	StripPrefix string `yaml:"strip_prefix"`
+	AddPrefix   string `yaml:"add_prefix"`
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+	Host        string `yaml:"host"`
+
+	regex *regexp.Regexp
+}
+
+// prepare fills the fields not specified with their
+// defaults and validates the configuration.
+func (rw *Rewrite) prepare() (err error) {
+	if rw.Host == "" {
+		rw.Host = DEFAULT_REWRITE_HOST
+	}
+
+	if rw.Host != HOST_PRESERVE && rw.Host != HOST_SERVER {
+		err = errors.Errorf(
+			"rewrite host must be one of '%s' or '%s' (got %s)",
+			HOST_PRESERVE, HOST_SERVER, rw.Host)
+		return
+	}
+
+	for _, prefix := range []string{rw.StripPrefix, rw.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			err = errors.Errorf(
+				"rewrite prefix %s must start with '/'", prefix)
+			return
+		}
+	}
+
+	if rw.Regex == "" {
+		if rw.Replacement != "" {
+			err = errors.Errorf(
+				"rewrite replacement requires a regex")
+		}
+		return
+	}
+
+	rw.regex, err = regexp.Compile(rw.Regex)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid rewrite regex %s", rw.Regex)
+		return
+	}
+
+	return
+}
+
+// rewritePath computes the path the request is forwarded with.
+func (rw *Rewrite) rewritePath(path string) string {
+	if rw.StripPrefix != "" && strings.HasPrefix(path, rw.StripPrefix) {
+		path = path[len(strings.TrimSuffix(rw.StripPrefix, "/")):]
+	}
+
+	if rw.regex != nil {
+		path = rw.regex.ReplaceAllString(path, rw.Replacement)
+	}
+
+	if rw.AddPrefix != "" {
+		path = strings.TrimSuffix(rw.AddPrefix, "/") + path
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return path
+}
+
+// apply rewrites the path of the request.
+func (rw *Rewrite) apply(ctx *fasthttp.RequestCtx) {
+	if rw.StripPrefix == "" && rw.AddPrefix == "" && rw.regex == nil {
+		return
+	}
+
+	ctx.URI().SetPath(rw.rewritePath(string(ctx.Path())))
+}
+
+// setRewrite makes the route rewrite the requests as
+// configured by `rw` (if any).
+func (r *route) setRewrite(rw *Rewrite) (err error) {
+	if rw == nil {
+		return
+	}
+
+	r.rewrite = new(Rewrite)
+	*r.rewrite = *rw
+
+	err = r.rewrite.prepare()
+	if err != nil {
+		return
+	}
+
+	if r.pool != nil {
+		r.pool.serverHost = r.rewrite.Host == HOST_SERVER
+	}
+
+	return
+}
@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewrite_prepare(t *testing.T) {
+	var rw = Rewrite{}
+	assert.NoError(t, rw.prepare())
+	assert.Equal(t, DEFAULT_REWRITE_HOST, rw.Host)
+
+	var testCases = []Rewrite{
+		{Host: "client"},
+		{StripPrefix: "billing"},
+		{AddPrefix: "v1/"},
+		{Regex: "("},
+		{Replacement: "/$1"},
+	}
+
+	for _, tc := range testCases {
+		assert.Error(t, tc.prepare(), "%+v", tc)
+	}
+}
+
+func TestRewrite_rewritePath(t *testing.T) {
+	var testCases = []struct {
+		rewrite  Rewrite
+		path     string
+		expected string
+	}{
+		{Rewrite{StripPrefix: "/billing"}, "/billing/invoices", "/invoices"},
+		{Rewrite{StripPrefix: "/billing/"}, "/billing/invoices", "/invoices"},
+		{Rewrite{StripPrefix: "/billing"}, "/billing", "/"},
+		{Rewrite{StripPrefix: "/billing"}, "/other", "/other"},
+		{Rewrite{AddPrefix: "/v1"}, "/users", "/v1/users"},
+		{Rewrite{AddPrefix: "/v1/"}, "/users", "/v1/users"},
+		{Rewrite{Regex: `^/users/(\d+)$`, Replacement: "/accounts/$1/profile"}, "/users/42", "/accounts/42/profile"},
+		{Rewrite{Regex: `^/users/(\d+)$`, Replacement: "/accounts/$1"}, "/users/me", "/users/me"},
+		{Rewrite{Regex: `\.php$`}, "/index.php", "/index"},
+		{Rewrite{StripPrefix: "/api", Regex: "^/v1", Replacement: "/v2", AddPrefix: "/internal"}, "/api/v1/users", "/internal/v2/users"},
+	}
+
+	for _, tc := range testCases {
+		assert.NoError(t, tc.rewrite.prepare())
+		assert.Equal(t, tc.expected, tc.rewrite.rewritePath(tc.path), "%+v %s", tc.rewrite, tc.path)
+	}
+}
+
+func TestL7_rewritesRequests(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.RequestURI())
+	}))
+	defer server.Close()
+
+	var address = strings.TrimPrefix(server.URL, "http://")
+
+	lb, err := New(Config{
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+				Rewrite: &Rewrite{AddPrefix: "/app"},
+				Routes: []Route{
+					{
+						Prefix:  "/billing",
+						Servers: []Server{{Address: server.URL}},
+						Rewrite: &Rewrite{StripPrefix: "/billing"},
+					},
+					{
+						Regex:   `^/users/\d+$`,
+						Servers: []Server{{Address: server.URL}},
+						Rewrite: &Rewrite{
+							Regex:       `^/users/(\d+)$`,
+							Replacement: "/accounts/$1",
+							Host:        HOST_SERVER,
+						},
+					},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var testCases = []struct {
+		uri      string
+		expected string
+	}{
+		{"/billing/invoices?page=2", "example.com /invoices?page=2"},
+		{"/billing", "example.com /"},
+		{"/users/42", address + " /accounts/42"},
+		{"/home?q=a%20b", "example.com /app/home?q=a%20b"},
+	}
+
+	for _, tc := range testCases {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d%s", lb.port, tc.uri), nil)
+		assert.NoError(t, err)
+		req.Host = "example.com"
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, tc.expected, string(body), tc.uri)
+	}
+}
+
+func TestLoadBackends_failsOnInvalidRewrite(t *testing.T) {
+	var lb = L7{}
+
+	assert.Error(t, lb.LoadBackends(map[string]Backend{
+		"example.com": Backend{
+			Routes: []Route{{
+				Prefix:  "/billing",
+				Rewrite: &Rewrite{Host: "client"},
+			}},
+		},
+	}))
+
+	assert.Error(t, lb.LoadBackends(map[string]Backend{
+		"example.com": Backend{
+			Rewrite: &Rewrite{Regex: "("},
+		},
+	}))
+}
@@ -0,0 +1,313 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// route is the compiled form of a Route (or of the servers
+// declared directly under a Backend) pointing to the pool of
+// servers that should receive the matched requests - unless
+// they're answered by a redirect or a fixed response.
+type route struct {
+	name     string
+	path     []byte
+	regex    *regexp.Regexp
+	pool     *pool
+	rewrite  *Rewrite
+	redirect *Redirect
+	response *FixedResponse
+}
+
+// routeTable holds the compiled routes of a backend.
+//
+// Matching takes place in the following order:
+//  1. exact path rules;
+//  2. prefix rules, the longest matching prefix winning;
+//  3. regex rules, the first one (in declaration order) that
+//     matches winning;
+//  4. the servers declared directly under the backend.
+type routeTable struct {
+	name        string
+	certificate *tls.Certificate
+	forceHTTPS  bool
+	hsts        *HSTS
+	clientAuth  *ClientAuth
+	passthrough bool
+	exact       map[string]*route
+	prefixes    []*route
+	regexes     []*route
+	fallback    *route
+}
+
+func (r Route) validate() (err error) {
+	var kinds = 0
+
+	for _, value := range []string{r.Path, r.Prefix, r.Regex} {
+		if value != "" {
+			kinds++
+		}
+	}
+
+	if kinds != 1 {
+		err = errors.Errorf(
+			"route must specify exactly one of " +
+				"'path', 'prefix' or 'regex'")
+		return
+	}
+
+	if r.Regex == "" && !strings.HasPrefix(r.Path+r.Prefix, "/") {
+		err = errors.Errorf(
+			"route path %s must start with '/'",
+			r.Path+r.Prefix)
+		return
+	}
+
+	err = validateActions(r.Servers, r.Redirect, r.FixedResponse)
+	return
+}
+
+// validateActions makes sure that requests are either
+// forwarded to servers, redirected or answered with a fixed
+// response.
+func validateActions(servers []Server, rd *Redirect, fr *FixedResponse) (err error) {
+	var actions = 0
+
+	if len(servers) > 0 {
+		actions++
+	}
+	if rd != nil {
+		actions++
+	}
+	if fr != nil {
+		actions++
+	}
+
+	if actions > 1 {
+		err = errors.Errorf(
+			"only one of 'servers', 'redirect' or " +
+				"'fixed_response' can be specified")
+		return
+	}
+
+	return
+}
+
+// Name returns a human readable description of the
+// rule used by the route.
+func (r Route) Name() string {
+	switch {
+	case r.Path != "":
+		return "path:" + r.Path
+	case r.Prefix != "":
+		return "prefix:" + r.Prefix
+	case r.Regex != "":
+		return "regex:" + r.Regex
+	}
+
+	return "*"
+}
+
+// newRouteTable compiles the routes of a backend making use of
+// newPool to create the pool for each set of servers.
+func newRouteTable(be Backend,
+	newPool func(servers []Server) (*pool, error)) (rt *routeTable, err error) {
+	var (
+		p *pool
+		r *route
+	)
+
+	rt = &routeTable{
+		exact: make(map[string]*route),
+	}
+
+	for _, rule := range be.Routes {
+		err = rule.validate()
+		if err != nil {
+			err = errors.Wrapf(err,
+				"invalid route %s", rule.Name())
+			return
+		}
+
+		p, err = newPool(rule.Servers)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"couldn't create servers for route %s", rule.Name())
+			return
+		}
+
+		r = &route{
+			name: rule.Name(),
+			pool: p,
+		}
+
+		err = r.setHeaderRules(be, &rule)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"invalid headers for route %s", rule.Name())
+			return
+		}
+
+		err = r.setRewrite(rule.Rewrite)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"invalid rewrite for route %s", rule.Name())
+			return
+		}
+
+		switch {
+		case rule.Path != "":
+			_, present := rt.exact[rule.Path]
+			if present {
+				err = errors.Errorf(
+					"path %s specified more than once", rule.Path)
+				return
+			}
+			r.path = []byte(rule.Path)
+			rt.exact[rule.Path] = r
+		case rule.Prefix != "":
+			r.path = []byte(rule.Prefix)
+			rt.prefixes = append(rt.prefixes, r)
+		case rule.Regex != "":
+			r.regex, err = regexp.Compile(rule.Regex)
+			if err != nil {
+				err = errors.Wrapf(err,
+					"invalid regex %s", rule.Regex)
+				return
+			}
+			rt.regexes = append(rt.regexes, r)
+		}
+
+		err = r.setRedirect(rule.Redirect)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"invalid redirect for route %s", rule.Name())
+			return
+		}
+
+		err = r.setFixedResponse(rule.FixedResponse)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"invalid fixed_response for route %s", rule.Name())
+			return
+		}
+	}
+
+	sort.SliceStable(rt.prefixes, func(i, j int) bool {
+		return len(rt.prefixes[i].path) > len(rt.prefixes[j].path)
+	})
+
+	// A backend that only declares routes doesn't have
+	// a catch-all set of servers: requests that don't match
+	// any of the routes end up not being found.
+	if len(be.Servers) == 0 && len(be.Routes) > 0 &&
+		be.Redirect == nil && be.FixedResponse == nil {
+		return
+	}
+
+	err = validateActions(be.Servers, be.Redirect, be.FixedResponse)
+	if err != nil {
+		return
+	}
+
+	p, err = newPool(be.Servers)
+	if err != nil {
+		return
+	}
+
+	rt.fallback = &route{
+		name: "*",
+		pool: p,
+	}
+
+	err = rt.fallback.setHeaderRules(be, nil)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid headers")
+		return
+	}
+
+	err = rt.fallback.setRewrite(be.Rewrite)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid rewrite")
+		return
+	}
+
+	err = rt.fallback.setRedirect(be.Redirect)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid redirect")
+		return
+	}
+
+	err = rt.fallback.setFixedResponse(be.FixedResponse)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid fixed_response")
+	}
+	return
+}
+
+// setHeaderRules makes the pool of the route rewrite the
+// headers as per the rules of the backend followed by those
+// of the route (if any).
+func (r *route) setHeaderRules(be Backend, rule *Route) (err error) {
+	var request, response = []*HeaderRules{be.RequestHeaders}, []*HeaderRules{be.ResponseHeaders}
+	if rule != nil {
+		request = append(request, rule.RequestHeaders)
+		response = append(response, rule.ResponseHeaders)
+	}
+
+	requestHeaders, err := compileHeaderRules(request...)
+	if err != nil {
+		return
+	}
+
+	responseHeaders, err := compileHeaderRules(response...)
+	if err != nil {
+		return
+	}
+
+	if r.pool != nil {
+		r.pool.route = r.name
+		r.pool.requestHeaders = requestHeaders
+		r.pool.responseHeaders = responseHeaders
+	}
+
+	return
+}
+
+// match retrieves the route that should take care
+// of a request to the given path.
+func (rt *routeTable) match(path []byte) (r *route, found bool) {
+	if len(rt.exact) > 0 {
+		r, found = rt.exact[string(path)]
+		if found {
+			return
+		}
+	}
+
+	for _, r = range rt.prefixes {
+		if bytes.HasPrefix(path, r.path) {
+			found = true
+			return
+		}
+	}
+
+	for _, r = range rt.regexes {
+		if r.regex.Match(path) {
+			found = true
+			return
+		}
+	}
+
+	r = rt.fallback
+	found = r != nil
+	return
+}
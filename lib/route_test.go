@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dummyPool(servers []Server) (*pool, error) {
+	if len(servers) == 0 {
+		return nil, nil
+	}
+
+	return &pool{}, nil
+}
+
+func TestRouteTable_match(t *testing.T) {
+	var backend = Backend{
+		Servers: []Server{{Address: "default"}},
+		Routes: []Route{
+			{Prefix: "/api", Servers: []Server{{Address: "api"}}},
+			{Prefix: "/api/v2", Servers: []Server{{Address: "apiv2"}}},
+			{Path: "/api/health", Servers: []Server{{Address: "health"}}},
+			{Regex: `\.(css|js)$`, Servers: []Server{{Address: "assets"}}},
+			{Regex: `^/static/`, Servers: []Server{{Address: "static"}}},
+		},
+	}
+
+	var testCases = []struct {
+		path  string
+		route string
+		found bool
+	}{
+		{"/", "*", true},
+		{"/something", "*", true},
+		{"/api", "prefix:/api", true},
+		{"/api/users", "prefix:/api", true},
+		{"/apiary", "prefix:/api", true},
+		{"/api/v2/users", "prefix:/api/v2", true},
+		{"/api/health", "path:/api/health", true},
+		{"/api/health/", "prefix:/api", true},
+		{"/static/main.js", `regex:\.(css|js)$`, true},
+		{"/static/logo.png", "regex:^/static/", true},
+		{"/api/main.js", "prefix:/api", true},
+	}
+
+	rt, err := newRouteTable(backend, dummyPool)
+	assert.NoError(t, err)
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			r, found := rt.match([]byte(tc.path))
+			assert.Equal(t, tc.found, found)
+			if found {
+				assert.Equal(t, tc.route, r.name)
+			}
+		})
+	}
+}
+
+func TestRouteTable_matchWithoutCatchAll(t *testing.T) {
+	rt, err := newRouteTable(Backend{
+		Routes: []Route{
+			{Prefix: "/api", Servers: []Server{{Address: "api"}}},
+		},
+	}, dummyPool)
+	assert.NoError(t, err)
+
+	_, found := rt.match([]byte("/api/users"))
+	assert.True(t, found)
+
+	_, found = rt.match([]byte("/users"))
+	assert.False(t, found)
+}
+
+func TestNewRouteTable_failsOnInvalidRoutes(t *testing.T) {
+	var testCases = []struct {
+		description string
+		routes      []Route
+	}{
+		{
+			"no rule specified",
+			[]Route{{}},
+		},
+		{
+			"more than one rule specified",
+			[]Route{{Path: "/a", Prefix: "/a"}},
+		},
+		{
+			"path not starting with slash",
+			[]Route{{Prefix: "api"}},
+		},
+		{
+			"invalid regex",
+			[]Route{{Regex: "^/(api"}},
+		},
+		{
+			"duplicate exact path",
+			[]Route{{Path: "/a"}, {Path: "/a"}},
+		},
+		{
+			"servers and redirect",
+			[]Route{{
+				Path:     "/a",
+				Servers:  []Server{{Address: "a"}},
+				Redirect: &Redirect{URL: "/b"},
+			}},
+		},
+		{
+			"redirect and fixed response",
+			[]Route{{
+				Path:          "/a",
+				Redirect:      &Redirect{URL: "/b"},
+				FixedResponse: &FixedResponse{},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := newRouteTable(Backend{
+				Routes: tc.routes,
+			}, dummyPool)
+			assert.Error(t, err)
+		})
+	}
+}
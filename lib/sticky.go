@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DEFAULT_STICKY_COOKIE = "l7-affinity"
+	DEFAULT_STICKY_PATH   = "/"
+
+	cookieTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+)
+
+var (
+	setCookieHeader = "Set-Cookie"
+
+	// stickyProcessSecret signs the affinity cookies of the
+	// backends that don't specify a secret. Cookies signed with
+	// it stay valid across reloads, but not across restarts.
+	stickyProcessSecret = make([]byte, 32)
+)
+
+func init() {
+	_, err := rand.Read(stickyProcessSecret)
+	if err != nil {
+		panic(errors.Wrapf(err,
+			"couldn't generate sticky sessions secret"))
+	}
+}
+
+// Sticky configures cookie-based session affinity: the first
+// response to a client carries a signed cookie identifying the
+// server that answered it so that subsequent requests carrying
+// the cookie are forwarded to that same server.
+//
+// Requests whose server is gone, unhealthy or ejected are
+// balanced as usual (and get a new cookie).
+type Sticky struct {
+	Cookie   string        `yaml:"cookie"`
+	TTL      time.Duration `yaml:"ttl"`
+	Path     string        `yaml:"path"`
+	Domain   string        `yaml:"domain"`
+	Secure   bool          `yaml:"secure"`
+	HTTPOnly bool          `yaml:"http_only"`
+	SameSite string        `yaml:"same_site"`
+	Secret   string        `yaml:"secret"`
+
+	secret []byte
+}
+
+// prepare fills the fields not specified with their
+// defaults and validates the configuration.
+func (s *Sticky) prepare() (err error) {
+	if s.Cookie == "" {
+		s.Cookie = DEFAULT_STICKY_COOKIE
+	}
+
+	if s.Path == "" {
+		s.Path = DEFAULT_STICKY_PATH
+	}
+
+	if s.TTL < 0 {
+		err = errors.Errorf(
+			"sticky cookie ttl must be positive")
+		return
+	}
+
+	switch strings.ToLower(s.SameSite) {
+	case "":
+	case "lax":
+		s.SameSite = "Lax"
+	case "strict":
+		s.SameSite = "Strict"
+	case "none":
+		s.SameSite = "None"
+	default:
+		err = errors.Errorf(
+			"sticky cookie same_site must be one of "+
+				"'lax', 'strict' or 'none' (got %s)", s.SameSite)
+		return
+	}
+
+	if strings.ContainsAny(s.Cookie, "=;, \t") {
+		err = errors.Errorf(
+			"invalid sticky cookie name %s", s.Cookie)
+		return
+	}
+
+	s.secret = stickyProcessSecret
+	if s.Secret != "" {
+		s.secret = []byte(s.Secret)
+	}
+
+	return
+}
+
+// id identifies an upstream within the cookies.
+func (s *Sticky) id(u *upstream) string {
+	var mac = hmac.New(sha256.New, s.secret)
+
+	mac.Write([]byte("id:" + u.address))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (s *Sticky) sign(id string) string {
+	var mac = hmac.New(sha256.New, s.secret)
+
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// value creates the cookie value that points to the upstream.
+func (s *Sticky) value(u *upstream) string {
+	var id = s.id(u)
+	return id + "." + s.sign(id)
+}
+
+// verify retrieves the upstream id from the cookie value
+// in case its signature is valid.
+func (s *Sticky) verify(value []byte) (id string, ok bool) {
+	var parts = strings.SplitN(string(value), ".", 2)
+	if len(parts) != 2 {
+		return
+	}
+
+	ok = hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0])))
+	id = parts[0]
+	return
+}
+
+// setCookie makes the response point the client to the upstream.
+func (s *Sticky) setCookie(ctx *fasthttp.RequestCtx, u *upstream) {
+	var cookie = []string{
+		s.Cookie + "=" + s.value(u),
+		"Path=" + s.Path,
+	}
+
+	if s.Domain != "" {
+		cookie = append(cookie, "Domain="+s.Domain)
+	}
+
+	if s.TTL > 0 {
+		cookie = append(cookie,
+			"Max-Age="+strconv.Itoa(int(s.TTL.Seconds())),
+			"Expires="+time.Now().Add(s.TTL).UTC().Format(cookieTimeFormat))
+	}
+
+	if s.Secure {
+		cookie = append(cookie, "Secure")
+	}
+
+	if s.HTTPOnly {
+		cookie = append(cookie, "HttpOnly")
+	}
+
+	if s.SameSite != "" {
+		cookie = append(cookie, "SameSite="+s.SameSite)
+	}
+
+	ctx.Response.Header.Add(setCookieHeader, strings.Join(cookie, "; "))
+}
+
+// stickyUpstream retrieves the available upstream that the
+// request points to (if any).
+func (p *pool) stickyUpstream(ctx *fasthttp.RequestCtx, now time.Time) (u *upstream) {
+	var value = ctx.Request.Header.Cookie(p.sticky.Cookie)
+	if len(value) == 0 {
+		return
+	}
+
+	id, ok := p.sticky.verify(value)
+	if !ok {
+		return
+	}
+
+	u = p.stickyIds[id]
+	if u == nil || !u.isHealthy() || u.isEjected(now) {
+		u = nil
+	}
+
+	return
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestSticky_prepare(t *testing.T) {
+	var testCases = []struct {
+		description string
+		sticky      Sticky
+		shouldError bool
+	}{
+		{"defaults", Sticky{}, false},
+		{"same site normalized", Sticky{SameSite: "lax"}, false},
+		{"invalid same site", Sticky{SameSite: "sometimes"}, true},
+		{"invalid cookie name", Sticky{Cookie: "a=b"}, true},
+		{"negative ttl", Sticky{TTL: -time.Second}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			assert.Equal(t, tc.shouldError, tc.sticky.prepare() != nil)
+		})
+	}
+}
+
+func TestSticky_verify(t *testing.T) {
+	var (
+		s     = &Sticky{Secret: "secret"}
+		other = &Sticky{Secret: "other"}
+		u     = newUpstream("a:80", nil)
+	)
+
+	assert.NoError(t, s.prepare())
+	assert.NoError(t, other.prepare())
+
+	id, ok := s.verify([]byte(s.value(u)))
+	assert.True(t, ok)
+	assert.Equal(t, s.id(u), id)
+
+	_, ok = s.verify([]byte(other.value(u)))
+	assert.False(t, ok)
+
+	_, ok = s.verify([]byte(s.id(u) + ".forged"))
+	assert.False(t, ok)
+
+	_, ok = s.verify([]byte("garbage"))
+	assert.False(t, ok)
+}
+
+func TestSticky_setCookie(t *testing.T) {
+	var (
+		ctx = &fasthttp.RequestCtx{}
+		u   = newUpstream("a:80", nil)
+		s   = &Sticky{
+			Cookie:   "affinity",
+			TTL:      time.Hour,
+			Secure:   true,
+			HTTPOnly: true,
+			SameSite: "strict",
+		}
+	)
+
+	assert.NoError(t, s.prepare())
+	s.setCookie(ctx, u)
+
+	cookie := string(ctx.Response.Header.Peek("Set-Cookie"))
+	assert.True(t, strings.HasPrefix(cookie, "affinity="+s.value(u)+"; Path=/"))
+	assert.Contains(t, cookie, "Max-Age=3600")
+	assert.Contains(t, cookie, "Expires=")
+	assert.Contains(t, cookie, "; Secure")
+	assert.Contains(t, cookie, "; HttpOnly")
+	assert.Contains(t, cookie, "; SameSite=Strict")
+}
@@ -0,0 +1,442 @@
+package lib
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_TCP_CONNECT_TIMEOUT = 5 * time.Second
+	DEFAULT_TCP_IDLE_TIMEOUT    = 5 * time.Minute
+
+	TCP_SCHEMA_PREFIX = "tcp://"
+
+	// tcpListenerPrefix prefixes the names of the TCP
+	// listeners when handing them over on upgrades.
+	tcpListenerPrefix = "tcp:"
+)
+
+// TCP is a listener whose connections are spliced to one of its
+// servers, picked by the same balancing algorithms (and subject
+// to the same health checks) used for HTTP.
+//
+// Health checks only verify that connections to the servers
+// can be established.
+type TCP struct {
+	Port           int           `yaml:"port"`
+	Algorithm      string        `yaml:"algorithm"`
+	Servers        []Server      `yaml:"servers"`
+	HealthCheck    *HealthCheck  `yaml:"health_check"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	MaxConnections int           `yaml:"max_connections"`
+
+	SendProxyProtocol string `yaml:"send_proxy_protocol"`
+}
+
+// tcpProxy is the configuration in effect for a TCP listener.
+type tcpProxy struct {
+	port           int
+	pool           *pool
+	algorithm      string
+	connectTimeout time.Duration
+	idleTimeout    time.Duration
+	maxConnections int64
+}
+
+// tcpListener accepts the connections of a TCP listener,
+// keeping track of how many are open.
+type tcpListener struct {
+	net.Listener
+	name   string
+	active int64
+}
+
+// NormalizeTCPAddress turns `[tcp://]host:port` into `host:port`.
+func NormalizeTCPAddress(address string) (res string, err error) {
+	if strings.HasPrefix(strings.ToLower(address), TCP_SCHEMA_PREFIX) {
+		address = address[len(TCP_SCHEMA_PREFIX):]
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		err = errors.Wrapf(err, "Invalid address %s", address)
+		return
+	}
+
+	if host == "" || port == "" {
+		err = errors.Errorf("Address %s must have a host and a port", address)
+		return
+	}
+
+	res = net.JoinHostPort(host, port)
+	return
+}
+
+// compiledTCP is the configuration of the TCP listeners,
+// validated and ready to replace the current one.
+type compiledTCP struct {
+	proxies      map[string]*tcpProxy
+	upstreams    map[string]*upstream
+	previous     map[string]*upstream
+	healthChecks map[*upstream]*HealthCheck
+}
+
+// LoadTCP (re)loads the configuration of the TCP listeners.
+//
+// Listeners are only started by `Listen`: those added
+// afterwards (or whose port changed) require a restart.
+func (lb *L7) LoadTCP(listeners map[string]TCP) (err error) {
+	compiled, err := lb.compileTCP(listeners)
+	if err != nil {
+		return
+	}
+
+	lb.Lock()
+	lb.setTCP(compiled)
+	lb.Unlock()
+
+	lb.startTCPHealthChecks(compiled)
+	return
+}
+
+// setTCP replaces the current configuration of the TCP
+// listeners, the write lock being held by the caller.
+//
+// As listeners can't be started (nor moved to another port)
+// once listening, the changes that require a restart are
+// logged.
+func (lb *L7) setTCP(compiled *compiledTCP) {
+	if lb.listener != nil {
+		var listening = make(map[string]int, len(lb.tcpListeners))
+		for _, l := range lb.tcpListeners {
+			listening[l.name] = l.Addr().(*net.TCPAddr).Port
+		}
+
+		for name, proxy := range compiled.proxies {
+			port, found := listening[name]
+			if !found {
+				lb.logger.Warn().
+					Str("tcp", name).
+					Int("port", proxy.port).
+					Msg("tcp listener added, restart required to listen")
+			} else if port != proxy.port {
+				lb.logger.Warn().
+					Str("tcp", name).
+					Int("port", port).
+					Int("new_port", proxy.port).
+					Msg("tcp listener port changed, restart required to listen")
+				proxy.port = port
+			}
+		}
+	}
+
+	lb.tcpProxies = compiled.proxies
+	lb.tcpUpstreams = compiled.upstreams
+}
+
+// startTCPHealthChecks (re)configures the health checks of
+// the upstreams of the TCP listeners once replaced, stopping
+// those of the upstreams that aren't used anymore.
+func (lb *L7) startTCPHealthChecks(compiled *compiledTCP) {
+	for u, hc := range compiled.healthChecks {
+		u.setHealthCheck(hc, lb.logger)
+	}
+
+	for key, u := range compiled.previous {
+		if compiled.upstreams[key] != u {
+			u.setHealthCheck(nil, lb.logger)
+		}
+	}
+}
+
+// compileTCP validates the configuration of the TCP listeners,
+// creating the pools of servers they're made of.
+func (lb *L7) compileTCP(listeners map[string]TCP) (compiled *compiledTCP, err error) {
+	var (
+		proxies      = make(map[string]*tcpProxy, len(listeners))
+		upstreams    = make(map[string]*upstream)
+		healthChecks = make(map[*upstream]*HealthCheck)
+	)
+
+	lb.RLock()
+	previousUpstreams := lb.tcpUpstreams
+	lb.RUnlock()
+
+	for name, cfg := range listeners {
+		if strings.ContainsAny(name, ",=") {
+			err = errors.Errorf(
+				"Can't load tcp listener %s: name can't contain ',' or '='",
+				name)
+			return
+		}
+
+		var (
+			proxy = &tcpProxy{
+				port:           cfg.Port,
+				algorithm:      cfg.Algorithm,
+				connectTimeout: cfg.ConnectTimeout,
+				idleTimeout:    cfg.IdleTimeout,
+				maxConnections: int64(cfg.MaxConnections),
+			}
+			hc *HealthCheck
+		)
+
+		if proxy.connectTimeout == 0 {
+			proxy.connectTimeout = DEFAULT_TCP_CONNECT_TIMEOUT
+		}
+
+		if proxy.idleTimeout == 0 {
+			proxy.idleTimeout = DEFAULT_TCP_IDLE_TIMEOUT
+		}
+
+		if cfg.Port <= 0 || cfg.Port > 65535 {
+			err = errors.Errorf(
+				"Can't load tcp listener %s: port must be between 1 and 65535",
+				name)
+			return
+		}
+
+		if proxy.connectTimeout < 0 || proxy.idleTimeout < 0 ||
+			proxy.maxConnections < 0 {
+			err = errors.Errorf(
+				"Can't load tcp listener %s: timeouts and limits must be positive",
+				name)
+			return
+		}
+
+		if cfg.HealthCheck != nil {
+			hc = new(HealthCheck)
+			*hc = *cfg.HealthCheck
+			err = hc.prepare()
+			if err != nil {
+				err = errors.Wrapf(err,
+					"Can't load tcp listener %s", name)
+				return
+			}
+		}
+
+		err = validateProxyProtocolVersion(cfg.SendProxyProtocol)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Can't load tcp listener %s", name)
+			return
+		}
+
+		proxy.pool, err = lb.newTCPPool(name, cfg, previousUpstreams, upstreams)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"Can't load tcp listener %s", name)
+			return
+		}
+
+		if proxy.pool != nil {
+			proxy.pool.sendProxy = cfg.SendProxyProtocol
+			for _, u := range proxy.pool.upstreams {
+				healthChecks[u] = hc
+			}
+		}
+
+		proxies[name] = proxy
+	}
+
+	compiled = &compiledTCP{
+		proxies:      proxies,
+		upstreams:    upstreams,
+		previous:     previousUpstreams,
+		healthChecks: healthChecks,
+	}
+	return
+}
+
+// newTCPPool creates the pool of servers of a TCP listener,
+// reusing the upstreams previously created for it.
+func (lb *L7) newTCPPool(name string, cfg TCP,
+	previous, current map[string]*upstream) (p *pool, err error) {
+	var weights []int
+
+	if len(cfg.Servers) == 0 {
+		lb.logger.Debug().Str("tcp", name).Msg("no servers")
+		return
+	}
+
+	p = &pool{
+		logger: lb.logger.With().
+			Str("tcp", name).
+			Logger(),
+	}
+
+	for _, server := range cfg.Servers {
+		address, err := NormalizeTCPAddress(server.Address)
+		if err != nil {
+			return nil, errors.Wrapf(err,
+				"Can't use address %s as a server address",
+				server.Address)
+		}
+
+		key := name + "|" + TCP_SCHEMA_PREFIX + address
+		u, found := current[key]
+		if !found {
+			u, found = previous[key]
+			if !found {
+				u = newTCPUpstream(address)
+			}
+			current[key] = u
+		}
+
+		if server.Weight < 0 {
+			return nil, errors.Errorf(
+				"Server %s can't have a negative weight",
+				server.Address)
+		}
+
+		if server.Weight == 0 {
+			server.Weight = 1
+		}
+
+		p.upstreams = append(p.upstreams, u)
+		weights = append(weights, server.Weight)
+	}
+
+	p.balancer, err = newBalancer(cfg.Algorithm, p.upstreams, weights)
+	return
+}
+
+// newTCPUpstream creates an upstream for the server of a TCP
+// listener at `address`: connections are spliced to it, so
+// there's no need for an HTTP client.
+func newTCPUpstream(address string) *upstream {
+	return &upstream{
+		address: address,
+		healthy: 1,
+		tcp:     true,
+	}
+}
+
+// probeTCP checks whether a connection to the server
+// can be established.
+func (u *upstream) probeTCP(hc *HealthCheck) (ok bool) {
+	conn, err := net.DialTimeout("tcp", u.address, hc.Timeout)
+	if err != nil {
+		return
+	}
+
+	conn.Close()
+	return true
+}
+
+// listenTCP starts the TCP listeners configured.
+func (lb *L7) listenTCP() (listeners []*tcpListener, err error) {
+	lb.RLock()
+	var ports = make(map[string]int, len(lb.tcpProxies))
+	for name, proxy := range lb.tcpProxies {
+		ports[name] = proxy.port
+	}
+	lb.RUnlock()
+
+	for name, port := range ports {
+		var ln net.Listener
+
+		ln, err = lb.listen(tcpListenerPrefix+name, port)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			err = errors.Wrapf(err,
+				"couldn't listen on tcp port %d (%s)",
+				port, name)
+			return
+		}
+
+		listeners = append(listeners, &tcpListener{
+			Listener: &trackingListener{Listener: ln, tracker: lb.conns},
+			name:     name,
+		})
+	}
+
+	return
+}
+
+// serveTCP proxies the connections accepted by the listener
+// until it gets closed.
+func (lb *L7) serveTCP(l *tcpListener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go lb.proxyTCP(l, conn)
+	}
+}
+
+// proxyTCP splices the client connection to one of the healthy
+// servers of the listener until either side closes it or it
+// stays idle for too long.
+func (lb *L7) proxyTCP(l *tcpListener, client net.Conn) {
+	defer client.Close()
+	setLongLived(client)
+
+	lb.RLock()
+	proxy := lb.tcpProxies[l.name]
+	lb.RUnlock()
+
+	var logger = lb.logger.With().
+		Str("tcp", l.name).
+		Str("client", client.RemoteAddr().String()).
+		Logger()
+
+	if proxy == nil || proxy.pool == nil {
+		logger.Warn().
+			Msg("no servers in tcp listener")
+		return
+	}
+
+	active := atomic.AddInt64(&l.active, 1)
+	defer atomic.AddInt64(&l.active, -1)
+
+	if proxy.maxConnections > 0 && active > proxy.maxConnections {
+		logger.Warn().
+			Int64("max", proxy.maxConnections).
+			Msg("too many connections")
+		return
+	}
+
+	var key []byte
+	if proxy.algorithm == ALGORITHM_CONSISTENT_HASH {
+		key = hashOnAddr(client.RemoteAddr())
+	}
+
+	u := proxy.pool.pick(key)
+	if u == nil {
+		logger.Warn().
+			Msg("no healthy servers in tcp listener")
+		return
+	}
+
+	start := time.Now()
+	server, err := u.dial(proxy.connectTimeout,
+		proxy.pool.proxyHeader(client.RemoteAddr(), client.LocalAddr()))
+	proxy.pool.report(u, time.Since(start), err != nil)
+	if err != nil {
+		logger.Warn().
+			Err(err).
+			Str("server", u.address).
+			Msg("couldn't connect to server")
+		return
+	}
+
+	atomic.AddInt64(&u.conns, 1)
+	defer atomic.AddInt64(&u.conns, -1)
+
+	logger.Debug().
+		Str("server", u.address).
+		Msg("splicing connection")
+
+	splice(client, server, client, server, proxy.idleTimeout)
+}
@@ -0,0 +1,231 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createTCPServer creates a server that greets the clients
+// with its name and then echoes back what it receives.
+func createTCPServer(t *testing.T, name string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				fmt.Fprintln(conn, name)
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func dialTCP(port int) (conn net.Conn, br *bufio.Reader, greeting string, err error) {
+	conn, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	br = bufio.NewReader(conn)
+	greeting, err = br.ReadString('\n')
+	return
+}
+
+// freePort retrieves a port that's free to listen on.
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func tcpPort(lb *L7, name string) int {
+	lb.RLock()
+	defer lb.RUnlock()
+
+	for _, l := range lb.tcpListeners {
+		if l.name == name {
+			return l.Addr().(*net.TCPAddr).Port
+		}
+	}
+
+	return 0
+}
+
+func TestNormalizeTCPAddress(t *testing.T) {
+	var testCases = []struct {
+		address     string
+		expected    string
+		shouldError bool
+	}{
+		{"localhost:5432", "localhost:5432", false},
+		{"tcp://10.0.0.1:6379", "10.0.0.1:6379", false},
+		{"TCP://[::1]:6379", "[::1]:6379", false},
+		{"localhost", "", true},
+		{":5432", "", true},
+		{"localhost:", "", true},
+	}
+
+	for _, tc := range testCases {
+		actual, err := NormalizeTCPAddress(tc.address)
+		if tc.shouldError {
+			assert.Error(t, err, tc.address)
+			continue
+		}
+
+		assert.NoError(t, err, tc.address)
+		assert.Equal(t, tc.expected, actual)
+	}
+}
+
+func TestLoadTCP_failsOnInvalidConfiguration(t *testing.T) {
+	var testCases = map[string]TCP{
+		"address":    TCP{Port: 1, Servers: []Server{{Address: "localhost"}}},
+		"algorithm":  TCP{Port: 1, Algorithm: "unknown", Servers: []Server{{Address: "localhost:1"}}},
+		"port":       TCP{Port: -1},
+		"no port":    TCP{},
+		"big port":   TCP{Port: 65536},
+		"timeout":    TCP{Port: 1, IdleTimeout: -time.Second},
+		"limit":      TCP{Port: 1, MaxConnections: -1},
+		"weight":     TCP{Port: 1, Servers: []Server{{Address: "localhost:1", Weight: -1}}},
+		"name,comma": TCP{Port: 1},
+	}
+
+	for name, cfg := range testCases {
+		var lb = L7{}
+		assert.Error(t, lb.LoadTCP(map[string]TCP{name: cfg}), name)
+	}
+}
+
+func TestL7_proxiesTCPConnections(t *testing.T) {
+	var (
+		first  = createTCPServer(t, "first")
+		second = createTCPServer(t, "second")
+	)
+	defer first.Close()
+	defer second.Close()
+
+	lb, err := New(Config{
+		TCP: map[string]TCP{
+			"echo": TCP{
+				Port:      freePort(t),
+				Algorithm: ALGORITHM_ROUND_ROBIN,
+				Servers: []Server{
+					{Address: first.Addr().String()},
+					{Address: "tcp://" + second.Addr().String()},
+				},
+			},
+			"limited": TCP{
+				Port:           freePort(t),
+				MaxConnections: 1,
+				Servers:        []Server{{Address: first.Addr().String()}},
+			},
+			"idle": TCP{
+				Port:        freePort(t),
+				IdleTimeout: 100 * time.Millisecond,
+				Servers:     []Server{{Address: first.Addr().String()}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// connections are balanced and spliced to the servers
+	var greetings = map[string]int{}
+	for i := 0; i < 4; i++ {
+		conn, br, greeting, err := dialTCP(tcpPort(&lb, "echo"))
+		assert.NoError(t, err)
+
+		fmt.Fprintln(conn, "hello")
+		echo, err := br.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\n", echo)
+
+		conn.Close()
+		greetings[greeting]++
+	}
+
+	assert.Equal(t, map[string]int{"first\n": 2, "second\n": 2}, greetings)
+
+	// connections beyond the limit are refused
+	conn, _, _, err := dialTCP(tcpPort(&lb, "limited"))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, _, _, err = dialTCP(tcpPort(&lb, "limited"))
+	assert.Equal(t, io.EOF, err)
+
+	// idle connections are closed
+	conn, br, _, err := dialTCP(tcpPort(&lb, "idle"))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	start := time.Now()
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestL7_skipsUnhealthyTCPServers(t *testing.T) {
+	var (
+		healthy = createTCPServer(t, "healthy")
+		down    = createTCPServer(t, "down")
+	)
+	defer healthy.Close()
+	down.Close()
+
+	lb, err := New(Config{
+		TCP: map[string]TCP{
+			"echo": TCP{
+				Port:      freePort(t),
+				Algorithm: ALGORITHM_ROUND_ROBIN,
+				HealthCheck: &HealthCheck{
+					Interval:           10 * time.Millisecond,
+					UnhealthyThreshold: 1,
+				},
+				Servers: []Server{
+					{Address: healthy.Addr().String()},
+					{Address: down.Addr().String()},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		conn, _, greeting, err := dialTCP(tcpPort(&lb, "echo"))
+		assert.NoError(t, err)
+		conn.Close()
+		assert.Equal(t, "healthy\n", greeting)
+	}
+}
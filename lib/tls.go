@@ -0,0 +1,244 @@
+package lib
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_TLS_PORT        = 443
+	DEFAULT_TLS_MIN_VERSION = "1.2"
+)
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	// tlsCipherSuites are the (TLS 1.0-1.2) cipher suites
+	// offered: forward secrecy and AEAD only. TLS 1.3 suites
+	// are not configurable.
+	tlsCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	}
+)
+
+// TLS configures the HTTPS listener.
+//
+// `Cert` and `Key` (PEM files) specify the certificate served
+// when no backend certificate matches the SNI name sent by the
+// client. `ClientAuth` applies to the backends that don't
+// specify their own.
+type TLS struct {
+	Port       int         `yaml:"port"`
+	Cert       string      `yaml:"cert"`
+	Key        string      `yaml:"key"`
+	MinVersion string      `yaml:"min_version"`
+	ClientAuth *ClientAuth `yaml:"client_auth"`
+}
+
+// BackendTLS specifies the certificate (and key) served for
+// the domains of a backend.
+type BackendTLS struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+func loadCertificate(certFile, keyFile string) (cert *tls.Certificate, err error) {
+	if certFile == "" || keyFile == "" {
+		err = errors.Errorf(
+			"both certificate and key must be specified")
+		return
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't load certificate %s and key %s",
+			certFile, keyFile)
+		return
+	}
+
+	cert = &pair
+	return
+}
+
+// compiledTLS is the global TLS configuration, validated and
+// ready to replace the current one.
+type compiledTLS struct {
+	config      *tls.Config
+	certificate *tls.Certificate
+	clientAuth  *ClientAuth
+}
+
+// LoadTLS (re)loads the global TLS configuration.
+//
+// Changes take effect on new handshakes only, leaving the
+// existing connections untouched. The port is only taken into
+// account when starting to listen.
+func (lb *L7) LoadTLS(cfg *TLS) (err error) {
+	compiled, err := lb.compileTLS(cfg)
+	if err != nil {
+		return
+	}
+
+	lb.Lock()
+	lb.setTLS(compiled)
+	lb.Unlock()
+	return
+}
+
+// setTLS replaces the current TLS configuration, the write
+// lock being held by the caller.
+func (lb *L7) setTLS(compiled *compiledTLS) {
+	lb.tlsConfig = compiled.config
+	lb.certificate = compiled.certificate
+	lb.clientAuth = compiled.clientAuth
+}
+
+// compileTLS validates the TLS configuration and loads the
+// certificates it refers to.
+//
+// TLS can't be turned off once the HTTPS listener is up (nor
+// turned on after the plain one started) as listeners are
+// only created when starting.
+func (lb *L7) compileTLS(cfg *TLS) (compiled *compiledTLS, err error) {
+	var (
+		cert    *tls.Certificate
+		ca      *ClientAuth
+		version uint16
+		found   bool
+	)
+
+	lb.RLock()
+	listening, withTLS := lb.listener != nil, lb.tlsListener != nil
+	lb.RUnlock()
+
+	if listening && withTLS != (cfg != nil) {
+		err = errors.Errorf(
+			"tls can't be enabled nor disabled without a restart")
+		return
+	}
+
+	compiled = &compiledTLS{}
+	if cfg == nil {
+		return
+	}
+
+	var minVersion = cfg.MinVersion
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err = loadCertificate(cfg.Cert, cfg.Key)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"couldn't load default certificate")
+			return
+		}
+	}
+
+	if cfg.ClientAuth != nil {
+		ca = new(ClientAuth)
+		*ca = *cfg.ClientAuth
+		err = ca.prepare()
+		if err != nil {
+			return
+		}
+	}
+
+	if minVersion == "" {
+		minVersion = DEFAULT_TLS_MIN_VERSION
+	}
+
+	version, found = tlsVersions[minVersion]
+	if !found {
+		err = errors.Errorf(
+			"unknown tls min_version %s "+
+				"(available: 1.0, 1.1, 1.2, 1.3)", minVersion)
+		return
+	}
+
+	lb.logger.Debug().
+		Str("min_version", minVersion).
+		Bool("default_certificate", cert != nil).
+		Bool("client_auth", ca != nil).
+		Msg("tls loaded")
+
+	compiled.config = &tls.Config{
+		MinVersion:   version,
+		CipherSuites: tlsCipherSuites,
+	}
+	compiled.certificate = cert
+	compiled.clientAuth = ca
+	return
+}
+
+// getCertificate picks the certificate of the backend that
+// matches the SNI name sent by the client, falling back to
+// the default certificate.
+func (lb *L7) getCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+	var name = strings.TrimSuffix(hello.ServerName, ".")
+
+	lb.RLock()
+	backends, cert := lb.backends, lb.certificate
+	lb.RUnlock()
+
+	if name != "" && backends != nil {
+		rt, found := backends.match([]byte(name))
+		if found && rt.certificate != nil {
+			cert = rt.certificate
+		}
+	}
+
+	if cert == nil {
+		err = errors.Errorf(
+			"no certificate available for %s", name)
+		return
+	}
+
+	return
+}
+
+// getConfigForClient makes new handshakes pick up the
+// latest TLS configuration, requesting client certificates
+// if the backend that matches the SNI name requires them.
+func (lb *L7) getConfigForClient(hello *tls.ClientHelloInfo) (cfg *tls.Config, err error) {
+	var rt *routeTable
+
+	lb.RLock()
+	cfg = lb.tlsConfig
+	if hello.ServerName != "" && lb.backends != nil {
+		rt, _ = lb.backends.match([]byte(strings.TrimSuffix(hello.ServerName, ".")))
+	}
+	lb.RUnlock()
+
+	if cfg == nil {
+		err = errors.Errorf("tls not configured")
+		return
+	}
+
+	// `lb` is only bound here as `L7` is handed
+	// around by value until it starts listening.
+	cfg = cfg.Clone()
+	cfg.GetCertificate = lb.getCertificate
+
+	if ca := lb.clientAuthFor(rt); ca != nil {
+		cfg.ClientCAs = ca.pool
+		cfg.ClientAuth = ca.mode()
+	}
+
+	if lb.http2 != nil {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	return
+}
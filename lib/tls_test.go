@@ -0,0 +1,224 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createCertificate writes a self-signed certificate (and its key)
+// for the given name to dir.
+func createCertificate(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+".key")
+
+	assert.NoError(t, ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return
+}
+
+func servedCertificateName(port int, serverName string, maxVersion uint16) (name string, err error) {
+	conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", port), &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		MaxVersion:         maxVersion,
+	})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	name = conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	return
+}
+
+func TestL7_selectsCertificateBySNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l7-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var server = createServer("secure")
+	defer server.Close()
+
+	defaultCert, defaultKey := createCertificate(t, dir, "default")
+	exampleCert, exampleKey := createCertificate(t, dir, "example.com")
+	wildcardCert, wildcardKey := createCertificate(t, dir, "wildcard")
+
+	lb, err := New(Config{
+		TLS: &TLS{
+			Cert: defaultCert,
+			Key:  defaultKey,
+		},
+		Backends: map[string]Backend{
+			"example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+				TLS:     &BackendTLS{Cert: exampleCert, Key: exampleKey},
+			},
+			"*.example.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+				TLS:     &BackendTLS{Cert: wildcardCert, Key: wildcardKey},
+			},
+			"other.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	lb.tlsPort = 0
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var testCases = map[string]string{
+		"example.com":     "example.com",
+		"www.example.com": "wildcard",
+		"other.com":       "default",
+		"unknown.com":     "default",
+		"":                "default",
+	}
+
+	for serverName, expected := range testCases {
+		name, err := servedCertificateName(lb.tlsPort, serverName, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, name, serverName)
+	}
+
+	// certificates are reloaded for new handshakes
+	reloadedCert, reloadedKey := createCertificate(t, dir, "reloaded")
+	assert.NoError(t, lb.LoadTLS(&TLS{
+		Cert:       reloadedCert,
+		Key:        reloadedKey,
+		MinVersion: "1.3",
+	}))
+
+	name, err := servedCertificateName(lb.tlsPort, "unknown.com", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "reloaded", name)
+
+	_, err = servedCertificateName(lb.tlsPort, "unknown.com", tls.VersionTLS12)
+	assert.Error(t, err)
+
+	// requests are proxied as usual
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	resp, err := client.Get(fmt.Sprintf("https://localhost:%d", lb.tlsPort))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://localhost:%d", lb.tlsPort), nil)
+	assert.NoError(t, err)
+	req.Host = "other.com"
+
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "secure", string(data))
+}
+
+func TestLoadTLS_failsOnInvalidConfiguration(t *testing.T) {
+	var lb L7
+
+	assert.Error(t, lb.LoadTLS(&TLS{MinVersion: "2.0"}))
+	assert.Error(t, lb.LoadTLS(&TLS{Cert: "/inexistent.pem"}))
+	assert.Error(t, lb.LoadTLS(&TLS{Cert: "/inexistent.pem", Key: "/inexistent.key"}))
+	assert.NoError(t, lb.LoadTLS(&TLS{}))
+	assert.NoError(t, lb.LoadTLS(nil))
+}
+
+func TestL7_reloadIsAllOrNothing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l7-reload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cert, key := createCertificate(t, dir, "default")
+
+	var cfg = Config{
+		TLS: &TLS{Cert: cert, Key: key},
+		Backends: map[string]Backend{
+			"a.com": Backend{Servers: []Server{{Address: "http://127.0.0.1:8081"}}},
+		},
+	}
+
+	lb, err := New(cfg)
+	assert.NoError(t, err)
+
+	lb.tlsPort = 0
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	cfg.Backends = map[string]Backend{
+		"b.com": Backend{Servers: []Server{{Address: "http://127.0.0.1:8082"}}},
+	}
+
+	// neither the backends nor tls change if one of them fails.
+	cfg.TLS = &TLS{Cert: cert, Key: key, MinVersion: "2.0"}
+	assert.Error(t, lb.Reload(cfg))
+	assert.Contains(t, lb.GetBackends(), "a.com")
+
+	cfg.TLS = nil
+	assert.Error(t, lb.Reload(cfg))
+	assert.Contains(t, lb.GetBackends(), "a.com")
+
+	cfg.TLS = &TLS{Cert: cert, Key: key, MinVersion: "1.3"}
+	assert.NoError(t, lb.Reload(cfg))
+	assert.Contains(t, lb.GetBackends(), "b.com")
+	assert.NotContains(t, lb.GetBackends(), "a.com")
+
+	lb.RLock()
+	assert.Equal(t, uint16(tls.VersionTLS13), lb.tlsConfig.MinVersion)
+	lb.RUnlock()
+}
@@ -0,0 +1,273 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DEFAULT_TUNNEL_IDLE_TIMEOUT = 5 * time.Minute
+
+	tunnelBufferSize = 32 * 1024
+)
+
+var (
+	upgradeHeader = []byte("Upgrade")
+	upgradeToken  = []byte("upgrade")
+)
+
+// isUpgrade tells whether the request asks to switch protocols
+// (e.g., to WebSocket) through the `Connection: Upgrade` and
+// `Upgrade` headers.
+//
+// Header names are matched regardless of their case as they
+// aren't normalized.
+func isUpgrade(ctx *fasthttp.RequestCtx) bool {
+	var connection, upgrade bool
+
+	ctx.Request.Header.VisitAll(func(key, value []byte) {
+		switch {
+		case bytes.EqualFold(key, connectionHeader):
+			for _, token := range bytes.Split(value, []byte(",")) {
+				if bytes.EqualFold(bytes.TrimSpace(token), upgradeToken) {
+					connection = true
+				}
+			}
+		case bytes.EqualFold(key, upgradeHeader):
+			upgrade = len(value) > 0
+		}
+	})
+
+	return connection && upgrade
+}
+
+// dialRaw opens a TCP connection to `address`, sending
+// `header` right away (if any).
+func dialRaw(address string, timeout time.Duration, header []byte) (conn net.Conn, err error) {
+	conn, err = net.DialTimeout("tcp", address, timeout)
+	if err != nil || len(header) == 0 {
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err = conn.Write(header)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	return
+}
+
+// dial opens a connection to the upstream, sending `header`
+// right away (if any) and speaking TLS if required.
+func (u *upstream) dial(timeout time.Duration, header []byte) (conn net.Conn, err error) {
+	conn, err = dialRaw(u.address, timeout, header)
+	if err != nil || u.client == nil || !u.client.IsTLS {
+		return
+	}
+
+	var cfg = &tls.Config{}
+	if u.client.TLSConfig != nil {
+		cfg = u.client.TLSConfig.Clone()
+	}
+
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(u.address)
+	}
+
+	// the upgrade only makes sense over HTTP/1.1.
+	cfg.NextProtos = []string{"http/1.1"}
+
+	tlsConn := tls.Client(conn, cfg)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	conn = tlsConn
+	return
+}
+
+// Upgrade forwards the upgrade request to one of the healthy
+// upstreams, returning the connection to it (and the reader of
+// what it sends) if it agreed to switch protocols.
+//
+// Otherwise, the response of the upstream is forwarded as is
+// and no connection is returned.
+func (p *pool) Upgrade(ctx *fasthttp.RequestCtx) (conn net.Conn, r io.Reader, err error) {
+	u, stick, err := p.choose(ctx)
+	if err != nil {
+		return
+	}
+
+	conn, err = u.dial(fasthttp.DefaultLBClientTimeout,
+		p.proxyHeader(ctx.RemoteAddr(), ctx.LocalAddr()))
+	if err != nil {
+		p.observe(u, true)
+		err = errors.Wrapf(err,
+			"couldn't connect to %s", u.address)
+		return
+	}
+
+	// the handshake must complete within the usual timeout.
+	conn.SetDeadline(time.Now().Add(fasthttp.DefaultLBClientTimeout))
+	p.rewriteRequest(ctx, u)
+
+	var (
+		bw = bufio.NewWriter(conn)
+		br = bufio.NewReader(conn)
+	)
+
+	err = ctx.Request.Write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = ctx.Response.Read(br)
+	}
+
+	failed := err != nil || ctx.Response.StatusCode() >= 500
+	p.observe(u, failed)
+
+	if err != nil {
+		conn.Close()
+		conn = nil
+		err = errors.Wrapf(err,
+			"couldn't upgrade connection to %s", u.address)
+		return
+	}
+
+	p.rewriteResponse(&ctx.Response.Header, ctx, u)
+	if stick {
+		p.sticky.setCookie(ctx, u)
+	}
+
+	if ctx.Response.StatusCode() != fasthttp.StatusSwitchingProtocols {
+		conn.Close()
+		conn = nil
+		return
+	}
+
+	// a switching protocols response has no body.
+	ctx.Response.Header.Del("Content-Length")
+	conn.SetDeadline(time.Time{})
+	r = br
+	return
+}
+
+// tunnel splices the bytes between two connections.
+type tunnel struct {
+	idleTimeout  time.Duration
+	lastActivity int64
+	closed       int32
+}
+
+// pipe copies what's read from `src` (through `r`) to `dst`
+// until `src` gets closed or the tunnel stays idle (in both
+// directions) for too long.
+func (t *tunnel) pipe(dst, src net.Conn, r io.Reader) (err error) {
+	var (
+		buf = make([]byte, tunnelBufferSize)
+		n   int
+	)
+
+	for {
+		src.SetReadDeadline(time.Now().Add(t.idleTimeout))
+
+		n, err = r.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
+
+			_, werr := dst.Write(buf[:n])
+			if werr != nil {
+				err = werr
+				return
+			}
+		}
+
+		if err != nil {
+			if isTimeout(err) && atomic.LoadInt32(&t.closed) == 0 &&
+				time.Since(time.Unix(0, atomic.LoadInt64(&t.lastActivity))) < t.idleTimeout {
+				continue
+			}
+
+			return
+		}
+	}
+}
+
+// splice forwards the bytes between the client and the
+// server until both sides are done.
+//
+// When one side finishes sending, the other is told so (if it
+// supports half-closing the connection) or the whole tunnel is
+// torn down.
+func splice(client, server net.Conn, clientReader, serverReader io.Reader, idleTimeout time.Duration) {
+	var (
+		t = &tunnel{
+			idleTimeout:  idleTimeout,
+			lastActivity: time.Now().UnixNano(),
+		}
+		done = make(chan struct{}, 2)
+	)
+
+	forward := func(dst, src net.Conn, r io.Reader) {
+		err := t.pipe(dst, src, r)
+
+		closer, ok := dst.(interface {
+			CloseWrite() error
+		})
+		if err == io.EOF && ok {
+			closer.CloseWrite()
+		} else {
+			// unblocks the other direction.
+			atomic.StoreInt32(&t.closed, 1)
+			client.SetDeadline(time.Now())
+			server.SetDeadline(time.Now())
+		}
+
+		done <- struct{}{}
+	}
+
+	go forward(server, client, clientReader)
+	go forward(client, server, serverReader)
+
+	<-done
+	<-done
+	server.Close()
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// proxyUpgrade forwards the upgrade request and, once the upstream
+// switches protocols, hijacks the client connection splicing
+// it with the upstream one.
+func (lb *L7) proxyUpgrade(ctx *fasthttp.RequestCtx, p *pool) (err error) {
+	server, serverReader, err := p.Upgrade(ctx)
+	if err != nil || server == nil {
+		return
+	}
+
+	ctx.Hijack(func(client net.Conn) {
+		lb.conns.setTunneled(client.LocalAddr(), client.RemoteAddr())
+		splice(client, server, client, serverReader, p.tunnelIdle)
+	})
+
+	return
+}
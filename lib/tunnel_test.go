@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+// createEchoServer creates a server that switches to an
+// `echo` protocol, sending back whatever it receives.
+func createEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(400)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+
+		io.Copy(conn, rw)
+	}))
+}
+
+func upgrade(port int, host, upgrade string) (conn net.Conn, br *bufio.Reader, resp *http.Response, err error) {
+	conn, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(conn, "GET /chat HTTP/1.1\r\nHost: %s\r\n"+
+		"connection: keep-alive, Upgrade\r\nupgrade: %s\r\n\r\n", host, upgrade)
+
+	br = bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, nil)
+	return
+}
+
+func TestIsUpgrade(t *testing.T) {
+	var testCases = []struct {
+		headers  map[string]string
+		expected bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, true},
+		{map[string]string{"connection": "keep-alive, upgrade", "upgrade": "websocket"}, true},
+		{map[string]string{"Connection": "Upgrade"}, false},
+		{map[string]string{"Connection": "keep-alive", "Upgrade": "websocket"}, false},
+		{map[string]string{"Connection": "upgrades", "Upgrade": "websocket"}, false},
+	}
+
+	for _, tc := range testCases {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.DisableNormalizing()
+		for key, value := range tc.headers {
+			ctx.Request.Header.Set(key, value)
+		}
+
+		assert.Equal(t, tc.expected, isUpgrade(&ctx), "%v", tc.headers)
+	}
+}
+
+func TestL7_tunnelsUpgradedConnections(t *testing.T) {
+	var server = createEchoServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		Backends: map[string]Backend{
+			"echo.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+			"idle.com": Backend{
+				Servers:           []Server{{Address: server.URL}},
+				TunnelIdleTimeout: 200 * time.Millisecond,
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, br, resp, err := upgrade(lb.port, "echo.com", "echo")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "echo", resp.Header.Get("Upgrade"))
+
+	for _, message := range []string{"hello", "world"} {
+		fmt.Fprint(conn, message)
+
+		buf := make([]byte, len(message))
+		_, err = io.ReadFull(br, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, message, string(buf))
+	}
+
+	// closing propagates to the server and back
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := ioutil.ReadAll(br)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	// refused upgrades are forwarded as any other response
+	conn, _, resp, err = upgrade(lb.port, "echo.com", "websocket")
+	assert.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// idle tunnels are closed
+	conn, br, resp, err = upgrade(lb.port, "idle.com", "echo")
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, 101, resp.StatusCode)
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestL7_authenticatesUpgrades(t *testing.T) {
+	var server = createEchoServer()
+	defer server.Close()
+
+	lb, err := New(Config{
+		Users: map[string]string{"user": "pass"},
+		Backends: map[string]Backend{
+			"echo.com": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, _, resp, err := upgrade(lb.port, "echo.com", "echo")
+	assert.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, 401, resp.StatusCode)
+}
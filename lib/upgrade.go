@@ -0,0 +1,288 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_UPGRADE_TIMEOUT = 30 * time.Second
+
+	// UPGRADE_LISTENERS_ENV lists the listeners inherited from
+	// the process being upgraded (`name=fd,...`).
+	UPGRADE_LISTENERS_ENV = "L7_LISTENERS"
+
+	// UPGRADE_READY_ENV holds the descriptor through which the
+	// new process reports that it's ready to serve.
+	UPGRADE_READY_ENV = "L7_READY_FD"
+
+	httpListenerName = "http"
+	tlsListenerName  = "https"
+
+	upgradeReadyMessage = "ready"
+)
+
+// inheritedListeners retrieves the descriptors of the listeners
+// handed over by the process being upgraded (if any).
+func inheritedListeners() (fds map[string]uintptr) {
+	fds = make(map[string]uintptr)
+
+	for _, pair := range strings.Split(os.Getenv(UPGRADE_LISTENERS_ENV), ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		fd, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			continue
+		}
+
+		fds[parts[0]] = uintptr(fd)
+	}
+
+	return
+}
+
+// listen creates the listener `name` on `port`, reusing the
+// listener inherited from the process being upgraded if any.
+//
+// PROXY protocol headers are read from the connections
+// accepted if configured.
+func (lb *L7) listen(name string, port int) (ln net.Listener, err error) {
+	fd, found := inheritedListeners()[name]
+	if found {
+		ln, err = lb.inherit(name, fd)
+	} else {
+		ln, err = net.Listen("tcp4", fmt.Sprintf(":%d", port))
+	}
+
+	if err == nil && lb.proxyProtocol != nil {
+		ln = newProxyListener(ln, lb.proxyProtocol)
+	}
+
+	return
+}
+
+// inherit creates a listener out of the descriptor inherited
+// from the process being upgraded.
+func (lb *L7) inherit(name string, fd uintptr) (ln net.Listener, err error) {
+	file := os.NewFile(fd, name)
+	defer file.Close()
+
+	ln, err = net.FileListener(file)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't use inherited %s listener", name)
+		return
+	}
+
+	lb.logger.Info().
+		Str("listener", name).
+		Str("address", ln.Addr().String()).
+		Msg("listener inherited")
+	return
+}
+
+// notifyReady lets the process being upgraded (if any) know
+// that the listeners are set up.
+func (lb *L7) notifyReady() {
+	defer os.Unsetenv(UPGRADE_LISTENERS_ENV)
+	defer os.Unsetenv(UPGRADE_READY_ENV)
+
+	fd, err := strconv.ParseUint(os.Getenv(UPGRADE_READY_ENV), 10, 32)
+	if err != nil {
+		return
+	}
+
+	file := os.NewFile(uintptr(fd), "ready")
+	defer file.Close()
+
+	_, err = fmt.Fprintln(file, upgradeReadyMessage)
+	if err != nil {
+		lb.logger.Error().
+			Err(err).
+			Msg("couldn't notify readiness")
+	}
+}
+
+// listenerFile duplicates the descriptor of a listener.
+func listenerFile(ln net.Listener) (file *os.File, err error) {
+	if tracking, ok := ln.(*trackingListener); ok {
+		ln = tracking.Listener
+	}
+
+	if proxied, ok := ln.(*proxyListener); ok {
+		ln = proxied.Listener
+	}
+
+	filer, ok := ln.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		err = errors.Errorf(
+			"listener %s can't be handed over", ln.Addr())
+		return
+	}
+
+	file, err = filer.File()
+	return
+}
+
+// listenerFiles duplicates the descriptors of the listeners
+// to be handed over, naming them after their position once
+// passed to the new process.
+func (lb *L7) listenerFiles() (files []*os.File, listeners []string, err error) {
+	lb.RLock()
+	defer lb.RUnlock()
+
+	var handedOver = map[string]net.Listener{
+		httpListenerName: lb.listener,
+		tlsListenerName:  lb.tlsListener,
+	}
+	for _, l := range lb.tcpListeners {
+		handedOver[tcpListenerPrefix+l.name] = l.Listener
+	}
+
+	for name, ln := range handedOver {
+		if ln == nil {
+			continue
+		}
+
+		var file *os.File
+		file, err = listenerFile(ln)
+		if err != nil {
+			return
+		}
+
+		// descriptors 0-2 are taken by stdin, stdout and stderr.
+		listeners = append(listeners,
+			fmt.Sprintf("%s=%d", name, 3+len(files)))
+		files = append(files, file)
+	}
+
+	return
+}
+
+// Upgrade starts a new process out of the executable l7 was
+// started from (with the same arguments), handing it the
+// listeners and waiting for it to be ready to serve.
+//
+// Once it succeeds, both processes accept connections until
+// the current one is shut down (see `Shutdown`). In case it
+// fails, the new process is killed and the current one keeps
+// serving as usual.
+func (lb *L7) Upgrade() (err error) {
+	var (
+		files     []*os.File
+		listeners []string
+		env       []string
+	)
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	files, listeners, err = lb.listenerFiles()
+	if err != nil {
+		return
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't create readiness pipe")
+		return
+	}
+	defer readyReader.Close()
+
+	files = append(files, readyWriter)
+
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, UPGRADE_LISTENERS_ENV+"=") &&
+			!strings.HasPrefix(variable, UPGRADE_READY_ENV+"=") {
+			env = append(env, variable)
+		}
+	}
+
+	env = append(env,
+		UPGRADE_LISTENERS_ENV+"="+strings.Join(listeners, ","),
+		UPGRADE_READY_ENV+"="+strconv.Itoa(2+len(files)))
+
+	// the path is resolved again so that a binary replaced
+	// in place is the one picked up.
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't find executable %s", os.Args[0])
+		return
+	}
+
+	cmd := &exec.Cmd{
+		Path:       path,
+		Args:       os.Args,
+		Env:        env,
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		ExtraFiles: files,
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't start %s", path)
+		return
+	}
+
+	lb.logger.Info().
+		Str("path", path).
+		Int("pid", cmd.Process.Pid).
+		Msg("upgrading, waiting for new process")
+
+	// our copy of the write end must be closed so that the read
+	// fails in case the new process exits.
+	readyWriter.Close()
+
+	var ready = make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(readyReader).ReadString('\n')
+		if err == nil && strings.TrimSpace(line) != upgradeReadyMessage {
+			err = errors.Errorf("unexpected message %q", line)
+		}
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(DEFAULT_UPGRADE_TIMEOUT):
+		err = errors.Errorf("timed out after %s", DEFAULT_UPGRADE_TIMEOUT)
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		err = errors.Wrapf(err,
+			"new process (pid %d) didn't get ready", cmd.Process.Pid)
+		return
+	}
+
+	// the new process is on its own from now on.
+	go cmd.Wait()
+
+	lb.logger.Info().
+		Int("pid", cmd.Process.Pid).
+		Msg("new process ready")
+	return
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInheritedListeners(t *testing.T) {
+	var testCases = map[string]map[string]uintptr{
+		"":                  map[string]uintptr{},
+		"http=3":            map[string]uintptr{"http": 3},
+		"http=3,https=4":    map[string]uintptr{"http": 3, "https": 4},
+		"http=x,https,ok=5": map[string]uintptr{"ok": 5},
+	}
+
+	defer os.Unsetenv(UPGRADE_LISTENERS_ENV)
+
+	for value, expected := range testCases {
+		os.Setenv(UPGRADE_LISTENERS_ENV, value)
+		assert.Equal(t, expected, inheritedListeners(), value)
+	}
+}
+
+func duplicate(t *testing.T, ln *net.TCPListener) int {
+	file, err := ln.File()
+	assert.NoError(t, err)
+	defer file.Close()
+
+	fd, err := syscall.Dup(int(file.Fd()))
+	assert.NoError(t, err)
+	return fd
+}
+
+func TestL7_servesFromInheritedListener(t *testing.T) {
+	var server = createServer("inherited")
+	defer server.Close()
+
+	// the listener a previous process would hand over
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	// descriptors are duplicated as they get closed once used.
+	listenerFd := duplicate(t, ln.(*net.TCPListener))
+	ln.Close()
+
+	readyReader, readyWriter, err := os.Pipe()
+	assert.NoError(t, err)
+	defer readyReader.Close()
+
+	readyFd, err := syscall.Dup(int(readyWriter.Fd()))
+	assert.NoError(t, err)
+	readyWriter.Close()
+
+	os.Setenv(UPGRADE_LISTENERS_ENV, fmt.Sprintf("http=%d", listenerFd))
+	os.Setenv(UPGRADE_READY_ENV, fmt.Sprintf("%d", readyFd))
+	defer os.Unsetenv(UPGRADE_LISTENERS_ENV)
+	defer os.Unsetenv(UPGRADE_READY_ENV)
+
+	lb, err := New(Config{
+		Backends: map[string]Backend{
+			"*": Backend{
+				Servers: []Server{{Address: server.URL}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	readyReader.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(readyReader).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "ready\n", line)
+
+	assert.Equal(t, "", os.Getenv(UPGRADE_LISTENERS_ENV))
+	assert.Equal(t, "", os.Getenv(UPGRADE_READY_ENV))
+
+	resp, err := targetHost("example.com", ln.Addr().(*net.TCPAddr).Port)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "inherited", string(data))
+}
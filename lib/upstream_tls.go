@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// UpstreamTLS configures how the connections to the `https`
+// servers of a backend are established.
+//
+// `CA` (PEM bundle) replaces the system roots when verifying the
+// servers, `ServerName` overrides the name sent via SNI (and
+// verified), `Cert` and `Key` specify the client certificate
+// presented to the servers that require one and
+// `InsecureSkipVerify` disables the verification altogether.
+type UpstreamTLS struct {
+	CA                 string `yaml:"ca"`
+	ServerName         string `yaml:"server_name"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+
+	config      *tls.Config
+	fingerprint string
+}
+
+// prepare loads the files referenced by the configuration,
+// creating the client TLS configuration.
+func (ut *UpstreamTLS) prepare() (err error) {
+	var (
+		digest = sha256.New()
+		pem    []byte
+	)
+
+	ut.config = &tls.Config{
+		ServerName:         ut.ServerName,
+		InsecureSkipVerify: ut.InsecureSkipVerify,
+	}
+
+	digest.Write([]byte(ut.ServerName + "|" +
+		strconv.FormatBool(ut.InsecureSkipVerify) + "|"))
+
+	if ut.CA != "" {
+		pem, err = ioutil.ReadFile(ut.CA)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"couldn't read upstream ca bundle %s", ut.CA)
+			return
+		}
+
+		ut.config.RootCAs = x509.NewCertPool()
+		if !ut.config.RootCAs.AppendCertsFromPEM(pem) {
+			err = errors.Errorf(
+				"no certificates found in upstream ca bundle %s", ut.CA)
+			return
+		}
+
+		digest.Write(pem)
+	}
+
+	if ut.Cert != "" || ut.Key != "" {
+		var cert *tls.Certificate
+
+		cert, err = loadCertificate(ut.Cert, ut.Key)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"couldn't load upstream client certificate")
+			return
+		}
+
+		ut.config.Certificates = []tls.Certificate{*cert}
+		for _, der := range cert.Certificate {
+			digest.Write(der)
+		}
+	}
+
+	ut.fingerprint = hex.EncodeToString(digest.Sum(nil))
+	return
+}
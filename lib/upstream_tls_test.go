@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createTLSServer creates an https server that answers with its
+// name, serving the given certificate and requiring clients to
+// present a certificate signed by `clientCA` if specified.
+func createTLSServer(t *testing.T, name, certFile, keyFile, clientCA string) *httptest.Server {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		assert.NoError(t, err)
+
+		server.TLS.ClientCAs = x509.NewCertPool()
+		server.TLS.ClientCAs.AppendCertsFromPEM(pem)
+		server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	server.StartTLS()
+	return server
+}
+
+func TestL7_speaksTLSToHttpsServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l7-upstream-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	localhostCert, localhostKey := createCertificate(t, dir, "localhost")
+	internalCert, internalKey := createCertificate(t, dir, "upstream.internal")
+	clientCert, clientKey := createCertificate(t, dir, "client")
+
+	var (
+		secure = createTLSServer(t, "secure", localhostCert, localhostKey, "")
+		mutual = createTLSServer(t, "mutual", internalCert, internalKey, clientCert)
+
+		secureAddress = strings.Replace(secure.URL, "127.0.0.1", "localhost", 1)
+		mutualAddress = strings.Replace(mutual.URL, "127.0.0.1", "localhost", 1)
+	)
+
+	defer secure.Close()
+	defer mutual.Close()
+
+	lb, err := New(Config{
+		Backends: map[string]Backend{
+			"ca.com": Backend{
+				Servers:     []Server{{Address: secureAddress}},
+				UpstreamTLS: &UpstreamTLS{CA: localhostCert},
+			},
+			"unknown-ca.com": Backend{
+				Servers: []Server{{Address: secureAddress}},
+			},
+			"insecure.com": Backend{
+				Servers:     []Server{{Address: secureAddress}},
+				UpstreamTLS: &UpstreamTLS{InsecureSkipVerify: true},
+			},
+			"mutual.com": Backend{
+				Servers: []Server{{Address: mutualAddress}},
+				UpstreamTLS: &UpstreamTLS{
+					CA:         internalCert,
+					ServerName: "upstream.internal",
+					Cert:       clientCert,
+					Key:        clientKey,
+				},
+			},
+			"no-client-cert.com": Backend{
+				Servers: []Server{{Address: mutualAddress}},
+				UpstreamTLS: &UpstreamTLS{
+					CA:         internalCert,
+					ServerName: "upstream.internal",
+				},
+			},
+			"wrong-name.com": Backend{
+				Servers: []Server{{Address: mutualAddress}},
+				UpstreamTLS: &UpstreamTLS{
+					CA:   internalCert,
+					Cert: clientCert,
+					Key:  clientKey,
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	defer lb.Stop()
+	go func() {
+		lb.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var testCases = []struct {
+		host   string
+		status int
+		body   string
+	}{
+		{"ca.com", 200, "secure"},
+		{"unknown-ca.com", 502, ""},
+		{"insecure.com", 200, "secure"},
+		{"mutual.com", 200, "mutual"},
+		{"no-client-cert.com", 502, ""},
+		{"wrong-name.com", 502, ""},
+	}
+
+	for _, tc := range testCases {
+		resp, err := targetHost(tc.host, lb.port)
+		assert.NoError(t, err)
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err)
+
+		assert.Equal(t, tc.status, resp.StatusCode, tc.host)
+		if tc.body != "" {
+			assert.Equal(t, tc.body, string(data), tc.host)
+		}
+	}
+}
+
+func TestUpstreamTLS_prepare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l7-upstream-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cert, key := createCertificate(t, dir, "localhost")
+	garbage := filepath.Join(dir, "garbage.pem")
+	assert.NoError(t, ioutil.WriteFile(garbage, []byte("garbage"), 0600))
+
+	var testCases = []struct {
+		config      UpstreamTLS
+		shouldError bool
+	}{
+		{UpstreamTLS{}, false},
+		{UpstreamTLS{CA: cert, Cert: cert, Key: key}, false},
+		{UpstreamTLS{CA: filepath.Join(dir, "missing.pem")}, true},
+		{UpstreamTLS{CA: garbage}, true},
+		{UpstreamTLS{Cert: cert}, true},
+	}
+
+	for _, tc := range testCases {
+		err := tc.config.prepare()
+		if tc.shouldError {
+			assert.Error(t, err, tc.config.CA)
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.NotEmpty(t, tc.config.fingerprint)
+	}
+
+	// changes to the configuration lead to new upstreams
+	var a, b = UpstreamTLS{}, UpstreamTLS{ServerName: "other"}
+	assert.NoError(t, a.prepare())
+	assert.NoError(t, b.prepare())
+	assert.NotEqual(t, a.fingerprint, b.fingerprint)
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"syscall"
 	"text/tabwriter"
+	"time"
 
 	"github.com/alexflint/go-arg"
 	"github.com/pkg/errors"
@@ -15,11 +16,18 @@ import (
 )
 
 type config struct {
-	Port    int      `arg:"-p,help:port to listen to"`
-	Config  string   `arg:"-c,help:configuration file to use"`
-	User    []string `arg:--user,help:list of allowed users to login`
-	Debug   bool     `arg:"-d,help:enabled debug logs"`
-	Servers []string `arg:"positional"`
+	Port    int           `arg:"-p,help:port to listen to"`
+	Config  string        `arg:"-c,help:configuration file to use"`
+	User    []string      `arg:"--user,help:list of allowed users to login"`
+	Debug   bool          `arg:"-d,help:enabled debug logs"`
+	TLSPort int           `arg:"--tls-port,help:port to listen to https requests"`
+	TLSCert string        `arg:"--tls-cert,help:certificate to serve https requests with"`
+	TLSKey  string        `arg:"--tls-key,help:key of the certificate to serve https requests with"`
+	Drain   time.Duration `arg:"--drain-timeout,help:time to wait for requests in flight when exiting"`
+	HTTP2   bool          `arg:"--http2,help:serve http/2 to the clients negotiating it over tls"`
+	H2C     bool          `arg:"--h2c,help:serve http/2 over plain connections too (prior knowledge)"`
+	Strip   bool          `arg:"--strip-auth,help:don't forward the credentials of the users to the servers"`
+	Servers []string      `arg:"positional"`
 }
 
 var (
@@ -27,36 +35,58 @@ var (
 	l7Config Config
 	err      error
 	sigs     = make(chan os.Signal)
+	exitCode = make(chan int, 1)
 )
 
-func ShowBackendsConfig(backends map[string]Backend) {
+func ShowBackendsConfig(lb *L7) {
 	var (
-		w   = new(tabwriter.Writer)
-		ndx int
-		srv Server
+		w      = new(tabwriter.Writer)
+		domain string
 	)
 
+	showServers := func(name, route string, servers []Server) {
+		for _, srv := range servers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+				domain, route, srv.Address,
+				lb.GetServerStatus(name, srv.Address))
+			domain, route = "*", "*"
+		}
+	}
+
 	w.Init(os.Stdout, 0, 8, 4, '\t', 0)
-	fmt.Fprintf(w, "BACKEND\tSERVER\n")
-	for domain, backend := range backends {
-		for ndx, srv = range backend.Servers {
-			if ndx == 0 {
-				fmt.Fprintf(w, "%s\t%s\n", domain, srv.Address)
-			} else {
-				fmt.Fprintf(w, "*\t%s\n", srv.Address)
-			}
+	fmt.Fprintf(w, "BACKEND\tROUTE\tSERVER\tSTATUS\n")
+	for name, backend := range lb.GetBackends() {
+		domain = name
+		showServers(name, "*", backend.Servers)
+		for _, route := range backend.Routes {
+			showServers(name, route.Name(), route.Servers)
 		}
-		fmt.Fprintf(w, "---\t---\n")
+		fmt.Fprintf(w, "---\t---\t---\t---\n")
 	}
 	w.Flush()
 }
 
+// shutdown drains the connections of the load-balancer,
+// setting the exit code accordingly.
+func shutdown(lb *L7) {
+	err := lb.Shutdown()
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't drain all connections.\n%s\n",
+			errors.Cause(err))
+		exitCode <- 1
+		return
+	}
+
+	exitCode <- 0
+}
+
 func handleSignals(lb *L7, args *config) {
 	for {
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs,
 			syscall.SIGHUP,
 			syscall.SIGUSR1,
+			syscall.SIGUSR2,
 			syscall.SIGINT,
 			syscall.SIGTERM)
 		switch <-sigs {
@@ -77,7 +107,7 @@ func handleSignals(lb *L7, args *config) {
 				continue
 			}
 
-			err = lb.LoadBackends(l7Config.Backends)
+			err = lb.Reload(l7Config)
 			if err != nil {
 				fmt.Printf("ERROR: Couldn't load configuration from "+
 					"file supplied %s\n%s\n", args.Config, errors.Cause(err))
@@ -86,15 +116,26 @@ func handleSignals(lb *L7, args *config) {
 			}
 
 			fmt.Println("INFO: Configuration reloaded")
-			ShowBackendsConfig(lb.GetBackends())
+			ShowBackendsConfig(lb)
 		case syscall.SIGUSR1:
-			ShowBackendsConfig(lb.GetBackends())
-		case syscall.SIGINT:
-			fmt.Println("Received SIGINT. Gracefully exiting.")
-			lb.Stop()
-		case syscall.SIGTERM:
-			fmt.Println("Received SIGTERM. Gracefully exiting.")
-			lb.Stop()
+			ShowBackendsConfig(lb)
+		case syscall.SIGUSR2:
+			fmt.Println("INFO: Received SIGUSR2. Upgrading.")
+			err = lb.Upgrade()
+			if err != nil {
+				fmt.Printf("ERROR: Couldn't upgrade.\n%s\n",
+					errors.Cause(err))
+				fmt.Println("No action taken.")
+				continue
+			}
+
+			fmt.Println("INFO: Upgraded. Gracefully exiting.")
+			shutdown(lb)
+			return
+		case syscall.SIGINT, syscall.SIGTERM:
+			fmt.Println("Received SIGINT/SIGTERM. Gracefully exiting.")
+			shutdown(lb)
+			return
 		}
 	}
 }
@@ -122,6 +163,10 @@ func main() {
 			Backends: backends,
 			Debug:    args.Debug,
 			Users:    make(map[string]string),
+
+			StripAuthorization: args.Strip,
+
+			DrainTimeout: args.Drain,
 		}
 
 		for _, usr := range args.User {
@@ -135,6 +180,18 @@ func main() {
 
 			l7Config.Users[pair[0]] = pair[1]
 		}
+
+		if args.TLSPort != 0 || args.TLSCert != "" || args.TLSKey != "" {
+			l7Config.TLS = &TLS{
+				Port: args.TLSPort,
+				Cert: args.TLSCert,
+				Key:  args.TLSKey,
+			}
+		}
+
+		if args.HTTP2 || args.H2C {
+			l7Config.HTTP2 = &HTTP2{H2C: args.H2C}
+		}
 	}
 
 	lb, err := New(l7Config)
@@ -146,7 +203,7 @@ func main() {
 
 	go handleSignals(&lb, args)
 
-	ShowBackendsConfig(lb.GetBackends())
+	ShowBackendsConfig(&lb)
 
 	err = lb.Listen()
 	if err != nil {
@@ -154,4 +211,6 @@ func main() {
 			l7Config, errors.Cause(err))
 		os.Exit(1)
 	}
+
+	os.Exit(<-exitCode)
 }